@@ -0,0 +1,164 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+)
+
+// loadAgeKeys reads the configured age recipients and identities.
+func (s *script) loadAgeKeys() error {
+	if s.c.AgePassphrase != "" && len(s.c.AgePublicKeys) != 0 {
+		return errors.New("loadAgeKeys: AGE_PASSPHRASE and AGE_PUBLIC_KEYS cannot be used at the same time")
+	}
+	for _, value := range s.c.AgePublicKeys {
+		recipients, keys, err := readAgeRecipients(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("loadAgeKeys: error reading AGE_PUBLIC_KEYS: %w", err)
+		}
+		s.ageRecipients = append(s.ageRecipients, recipients...)
+		s.ageRecipientKeys = append(s.ageRecipientKeys, keys...)
+	}
+	if s.c.AgeIdentities != "" {
+		identities, err := readAgeIdentities(s.c.AgeIdentities)
+		if err != nil {
+			return fmt.Errorf("loadAgeKeys: error reading AGE_IDENTITIES: %w", err)
+		}
+		s.ageIdentities = identities
+	}
+	return nil
+}
+
+// readAgeRecipients parses the given value, which is either an age or SSH
+// public key or the location of a file listing such keys one per line. Along
+// with the parsed recipients, the keys they have been parsed from are returned.
+func readAgeRecipients(value string) ([]age.Recipient, []string, error) {
+	if isAgeRecipient(value) {
+		recipient, err := parseAgeRecipient(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("readAgeRecipients: %w", err)
+		}
+		return []age.Recipient{recipient}, []string{value}, nil
+	}
+
+	f, err := os.Open(value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("readAgeRecipients: error opening %s: %w", value, err)
+	}
+	defer f.Close()
+
+	var recipients []age.Recipient
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		recipient, err := parseAgeRecipient(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("readAgeRecipients: error in line %d of %s: %w", n, value, err)
+		}
+		recipients = append(recipients, recipient)
+		keys = append(keys, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("readAgeRecipients: error reading %s: %w", value, err)
+	}
+	if len(recipients) == 0 {
+		return nil, nil, fmt.Errorf("readAgeRecipients: no public keys found in %s", value)
+	}
+	return recipients, keys, nil
+}
+
+// isAgeRecipient returns whether the given value is a public key instead of
+// the location of a file.
+func isAgeRecipient(value string) bool {
+	return strings.HasPrefix(value, "age1") || strings.HasPrefix(value, "ssh-")
+}
+
+// parseAgeRecipient parses a single age or SSH public key.
+func parseAgeRecipient(value string) (age.Recipient, error) {
+	if strings.HasPrefix(value, "ssh-") {
+		recipient, err := agessh.ParseRecipient(value)
+		if err != nil {
+			return nil, fmt.Errorf("parseAgeRecipient: error parsing SSH public key: %w", err)
+		}
+		return recipient, nil
+	}
+	recipient, err := age.ParseX25519Recipient(value)
+	if err != nil {
+		return nil, fmt.Errorf("parseAgeRecipient: error parsing public key: %w", err)
+	}
+	return recipient, nil
+}
+
+// readAgeIdentities parses the given value, which is either the contents or
+// the location of an age identity file or an unencrypted SSH private key.
+func readAgeIdentities(value string) ([]age.Identity, error) {
+	data := []byte(value)
+	if !strings.Contains(value, "AGE-SECRET-KEY-") && !strings.Contains(value, "-----BEGIN") {
+		var err error
+		if data, err = os.ReadFile(value); err != nil {
+			return nil, fmt.Errorf("readAgeIdentities: error reading %s: %w", value, err)
+		}
+	}
+
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		identity, err := agessh.ParseIdentity(data)
+		if err != nil {
+			return nil, fmt.Errorf("readAgeIdentities: error parsing SSH private key: %w", err)
+		}
+		return []age.Identity{identity}, nil
+	}
+	identities, err := age.ParseIdentities(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("readAgeIdentities: error parsing identities: %w", err)
+	}
+	return identities, nil
+}
+
+// newAgeWriter wraps the given writer so that all data written is encrypted
+// using the configured age passphrase or public keys.
+func (s *script) newAgeWriter(w io.Writer) (io.WriteCloser, error) {
+	if s.ageRecipients != nil {
+		return age.Encrypt(w, s.ageRecipients...)
+	}
+	recipient, err := age.NewScryptRecipient(s.c.AgePassphrase)
+	if err != nil {
+		return nil, fmt.Errorf("newAgeWriter: error creating recipient: %w", err)
+	}
+	return age.Encrypt(w, recipient)
+}
+
+// decryptAge wraps the given reader so that it yields the plaintext of a
+// backup that has been encrypted using the configured age passphrase or the
+// public keys matching the configured identities.
+func (s *script) decryptAge(r io.Reader) (io.Reader, error) {
+	identities := s.ageIdentities
+	if s.c.AgePassphrase != "" {
+		identity, err := age.NewScryptIdentity(s.c.AgePassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("decryptAge: error creating identity: %w", err)
+		}
+		identities = append(identities, identity)
+	}
+	if len(identities) == 0 {
+		return nil, errors.New("decryptAge: backup has been encrypted using age, but neither AGE_PASSPHRASE nor AGE_IDENTITIES was given")
+	}
+	plaintext, err := age.Decrypt(r, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("decryptAge: error decrypting backup: %w", err)
+	}
+	return plaintext, nil
+}
@@ -8,16 +8,40 @@ package main
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
-func createArchive(files []string, inputFilePath, outputFilePath string) error {
+// archiveOptions holds the options for writing an archive.
+type archiveOptions struct {
+	// manifest is added to the root of the archive in case it is not nil.
+	manifest *manifest
+	// captured holds command output that is added to the root of the archive.
+	captured []capturedOutput
+	// metadata preserves extended attributes, ACLs and holes in sparse files.
+	metadata bool
+	// sqliteDir is the directory consistent copies of SQLite databases are
+	// created in and archived instead of the files. In case it is empty,
+	// databases are archived as is.
+	sqliteDir string
+	// reproducible sorts entries and normalizes all header fields that do not
+	// describe the contents of a file, so archiving the same files twice
+	// yields the same bytes.
+	reproducible bool
+	compression  Compression
+	level        int
+	concurrency  int
+	// warn is passed a warning in case a file cannot be archived safely.
+	warn func(format string, args ...interface{})
+}
+
+func createArchive(files []string, inputFilePath, outputFilePath string, opts archiveOptions) error {
 	inputFilePath = stripTrailingSlashes(inputFilePath)
 	inputFilePath, outputFilePath, err := makeAbsolute(inputFilePath, outputFilePath)
 	if err != nil {
@@ -27,7 +51,7 @@ func createArchive(files []string, inputFilePath, outputFilePath string) error {
 		return fmt.Errorf("createArchive: error creating output file path: %w", err)
 	}
 
-	if err := compress(files, outputFilePath, filepath.Dir(inputFilePath)); err != nil {
+	if err := compress(files, outputFilePath, filepath.Dir(inputFilePath), opts); err != nil {
 		return fmt.Errorf("createArchive: error creating archive: %w", err)
 	}
 
@@ -51,41 +75,130 @@ func makeAbsolute(inputFilePath, outputFilePath string) (string, string, error)
 	return inputFilePath, outputFilePath, err
 }
 
-func compress(paths []string, outFilePath, subPath string) error {
+func compress(paths []string, outFilePath, subPath string, opts archiveOptions) error {
 	file, err := os.Create(outFilePath)
 	if err != nil {
 		return fmt.Errorf("compress: error creating out file: %w", err)
 	}
 
 	prefix := path.Dir(outFilePath)
-	gzipWriter := gzip.NewWriter(file)
-	tarWriter := tar.NewWriter(gzipWriter)
+	if err := writeArchive(paths, file, prefix, opts); err != nil {
+		return fmt.Errorf("compress: %w", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return fmt.Errorf("compress: error closing file: %w", err)
+	}
 
+	return nil
+}
+
+// writeArchive writes a compressed tar archive of the given paths to w using
+// the given options. The given prefix is trimmed from the paths when naming
+// the archive's entries.
+func writeArchive(paths []string, w io.Writer, prefix string, opts archiveOptions) error {
+	compressionWriter, err := newCompressionWriter(w, opts.compression, opts.level, opts.concurrency)
+	if err != nil {
+		return fmt.Errorf("writeArchive: error creating compression writer: %w", err)
+	}
+	tarWriter := tar.NewWriter(compressionWriter)
+
+	aw := &archiveWriter{
+		tw:           tarWriter,
+		w:            compressionWriter,
+		links:        map[fileID]string{},
+		metadata:     opts.metadata,
+		sqliteDir:    opts.sqliteDir,
+		reproducible: opts.reproducible,
+		warn:         opts.warn,
+	}
+	if opts.reproducible {
+		// Parents are always sorted before their children as their path is
+		// a prefix of their children's path.
+		paths = append([]string(nil), paths...)
+		sort.Strings(paths)
+	}
 	for _, p := range paths {
-		if err := writeTarGz(p, tarWriter, prefix); err != nil {
-			return fmt.Errorf("compress error writing %s to archive: %w", p, err)
+		if err := writeTarGz(p, aw, prefix); err != nil {
+			return fmt.Errorf("writeArchive: error writing %s to archive: %w", p, err)
 		}
 	}
 
-	err = tarWriter.Close()
-	if err != nil {
-		return fmt.Errorf("compress: error closing tar writer: %w", err)
+	if len(paths) != 0 {
+		for _, output := range opts.captured {
+			if err := writeCapturedOutput(output, aw, strings.TrimPrefix(paths[0], prefix)); err != nil {
+				return fmt.Errorf("writeArchive: error writing captured output to archive: %w", err)
+			}
+		}
 	}
 
-	err = gzipWriter.Close()
+	if opts.manifest != nil && len(paths) != 0 {
+		if err := writeManifest(opts.manifest, aw, strings.TrimPrefix(paths[0], prefix)); err != nil {
+			return fmt.Errorf("writeArchive: error writing manifest to archive: %w", err)
+		}
+	}
+
+	err = tarWriter.Close()
 	if err != nil {
-		return fmt.Errorf("compress: error closing gzip writer: %w", err)
+		return fmt.Errorf("writeArchive: error closing tar writer: %w", err)
 	}
 
-	err = file.Close()
+	err = compressionWriter.Close()
 	if err != nil {
-		return fmt.Errorf("compress: error closing file: %w", err)
+		return fmt.Errorf("writeArchive: error closing compression writer: %w", err)
 	}
 
 	return nil
 }
 
-func writeTarGz(path string, tarWriter *tar.Writer, prefix string) error {
+// archiveWriter holds the state needed for writing entries to an archive.
+type archiveWriter struct {
+	tw *tar.Writer
+	// w is the writer underlying tw, which is used for writing entries that
+	// cannot be encoded by tw.
+	w        io.Writer
+	links    map[fileID]string
+	metadata bool
+	// sqliteDir is the directory consistent copies of SQLite databases are
+	// created in. Databases are archived as is in case it is empty.
+	sqliteDir    string
+	reproducible bool
+	warn         func(format string, args ...interface{})
+}
+
+// normalizeHeader removes all fields from the given header that might change
+// without the contents of the file changing in case archives are to be
+// reproducible.
+func (aw *archiveWriter) normalizeHeader(header *tar.Header) {
+	if !aw.reproducible {
+		return
+	}
+	header.ModTime = header.ModTime.Truncate(time.Second)
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	header.Uname = ""
+	header.Gname = ""
+}
+
+// generatedModTime returns the modification time of entries that do not exist
+// on disk but are generated when creating the archive.
+func (aw *archiveWriter) generatedModTime() time.Time {
+	if aw.reproducible {
+		return time.Unix(0, 0)
+	}
+	return time.Now().Truncate(time.Second)
+}
+
+// fileID identifies a file on disk by its device and inode.
+type fileID struct {
+	dev, ino uint64
+}
+
+// writeTarGz writes the file at the given path to the archive. Files that are
+// hard links to a file that has already been written are stored as links to
+// the existing entry.
+func writeTarGz(path string, aw *archiveWriter, prefix string) error {
 	fileInfo, err := os.Lstat(path)
 	if err != nil {
 		return fmt.Errorf("writeTarGz: error getting file infor for %s: %w", path, err)
@@ -94,6 +207,11 @@ func writeTarGz(path string, tarWriter *tar.Writer, prefix string) error {
 	if fileInfo.Mode()&os.ModeSocket == os.ModeSocket {
 		return nil
 	}
+	// Journals of databases are part of the consistent copy of the database
+	// and would corrupt it when being restored next to it.
+	if aw.sqliteDir != "" && fileInfo.Mode().IsRegular() && isSQLiteJournal(path) {
+		return nil
+	}
 
 	var link string
 	if fileInfo.Mode()&os.ModeSymlink == os.ModeSymlink {
@@ -108,13 +226,38 @@ func writeTarGz(path string, tarWriter *tar.Writer, prefix string) error {
 		return fmt.Errorf("writeTarGz: error getting file info header: %w", err)
 	}
 	header.Name = strings.TrimPrefix(path, prefix)
+	aw.normalizeHeader(header)
 
-	err = tarWriter.WriteHeader(header)
-	if err != nil {
-		return fmt.Errorf("writeTarGz: error writing file info header: %w", err)
+	if aw.metadata {
+		xattrs, err := readXattrs(path)
+		if err != nil {
+			return fmt.Errorf("writeTarGz: error reading extended attributes: %w", err)
+		}
+		for name, value := range xattrs {
+			if header.PAXRecords == nil {
+				header.PAXRecords = map[string]string{}
+			}
+			header.PAXRecords[paxXattrPrefix+name] = value
+		}
+	}
+
+	if id, ok := hardLinkID(fileInfo); ok {
+		if linkname, seen := aw.links[id]; seen {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = linkname
+			header.Size = 0
+			if err := aw.tw.WriteHeader(header); err != nil {
+				return fmt.Errorf("writeTarGz: error writing hard link header: %w", err)
+			}
+			return nil
+		}
+		aw.links[id] = header.Name
 	}
 
 	if !fileInfo.Mode().IsRegular() {
+		if err := aw.tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("writeTarGz: error writing file info header: %w", err)
+		}
 		return nil
 	}
 
@@ -124,10 +267,321 @@ func writeTarGz(path string, tarWriter *tar.Writer, prefix string) error {
 	}
 	defer file.Close()
 
-	_, err = io.Copy(tarWriter, file)
+	if aw.sqliteDir != "" {
+		if ok, err := hasSQLiteHeader(file); err != nil {
+			return fmt.Errorf("writeTarGz: error reading %s: %w", path, err)
+		} else if ok {
+			if err := writeSQLiteEntry(aw, header, path); err != nil {
+				return fmt.Errorf("writeTarGz: error writing database %s: %w", path, err)
+			}
+			return nil
+		}
+	}
+
+	if aw.metadata {
+		regions, err := dataRegions(file, fileInfo)
+		if err != nil {
+			return fmt.Errorf("writeTarGz: error detecting holes in %s: %w", path, err)
+		}
+		if regions != nil {
+			if err := writeSparseEntry(aw, header, file, regions); err != nil {
+				return fmt.Errorf("writeTarGz: error writing sparse file %s: %w", path, err)
+			}
+			return nil
+		}
+	}
+
+	err = aw.tw.WriteHeader(header)
+	if err != nil {
+		return fmt.Errorf("writeTarGz: error writing file info header: %w", err)
+	}
+
+	_, err = io.Copy(aw.tw, file)
 	if err != nil {
 		return fmt.Errorf("writeTarGz: error copying %s to tar writer: %w", path, err)
 	}
 
 	return nil
 }
+
+// extractArchive reads a (compressed) tar archive from the given reader and writes
+// its contents to outputFilePath. The top level directory of the archive is
+// replaced with outputFilePath, i.e. an archive created from `/backup` will
+// have `/backup/data/file.txt` restored to `outputFilePath/data/file.txt`.
+// In case the archive contains a manifest, it is not extracted, but files
+// listed as deleted in it are removed from outputFilePath. In case metadata
+// is set, extended attributes, ACLs and holes in sparse files are restored.
+// Extended attributes that cannot be restored are skipped, passing a warning
+// for each of them to warn.
+func extractArchive(r io.Reader, outputFilePath string, metadata bool, warn func(format string, args ...interface{})) error {
+	outputFilePath, err := filepath.Abs(stripTrailingSlashes(outputFilePath))
+	if err != nil {
+		return fmt.Errorf("extractArchive: error getting absolute path: %w", err)
+	}
+	if err := os.MkdirAll(outputFilePath, 0755); err != nil {
+		return fmt.Errorf("extractArchive: error creating output file path: %w", err)
+	}
+
+	decompressionReader, err := newDecompressionReader(r)
+	if err != nil {
+		return fmt.Errorf("extractArchive: error creating decompression reader: %w", err)
+	}
+	defer decompressionReader.Close()
+	tarReader := tar.NewReader(decompressionReader)
+
+	var root string
+	var dirs []*tar.Header
+	var m *manifest
+	skipped := map[string]*skippedXattr{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("extractArchive: error reading tar header: %w", err)
+		}
+
+		name := path.Clean("/" + header.Name)
+		if root == "" {
+			root = name
+		}
+		if name != root && !strings.HasPrefix(name, strings.TrimSuffix(root, "/")+"/") {
+			return fmt.Errorf("extractArchive: archive entry %s is not contained in %s", name, root)
+		}
+		if strings.TrimPrefix(name, root) == "/"+manifestName {
+			if m, err = readManifestEntry(tarReader); err != nil {
+				return fmt.Errorf("extractArchive: %w", err)
+			}
+			continue
+		}
+		target := filepath.Join(outputFilePath, strings.TrimPrefix(name, root))
+
+		// Hard links reference other entries of the archive, which need to
+		// be mapped to their location on disk in the same way.
+		if header.Typeflag == tar.TypeLink {
+			linkname := path.Clean("/" + header.Linkname)
+			if linkname != root && !strings.HasPrefix(linkname, strings.TrimSuffix(root, "/")+"/") {
+				return fmt.Errorf("extractArchive: hard link %s points to %s which is not contained in %s", name, linkname, root)
+			}
+			header.Linkname = filepath.Join(outputFilePath, strings.TrimPrefix(linkname, root))
+			if err := checkSymlinks(outputFilePath, filepath.Dir(header.Linkname)); err != nil {
+				return fmt.Errorf("extractArchive: refusing to extract hard link %s: %w", name, err)
+			}
+		}
+
+		// Symlinks that have been extracted before must not be followed, as
+		// entries could be written outside of outputFilePath otherwise.
+		parent := filepath.Dir(target)
+		if header.Typeflag == tar.TypeDir {
+			parent = target
+		}
+		if err := checkSymlinks(outputFilePath, parent); err != nil {
+			return fmt.Errorf("extractArchive: refusing to extract %s: %w", name, err)
+		}
+
+		if err := extractTarEntry(header, tarReader, target, metadata, skipped); err != nil {
+			return fmt.Errorf("extractArchive: error extracting %s: %w", name, err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			header.Name = target
+			dirs = append(dirs, header)
+		}
+	}
+
+	if err := drain(decompressionReader); err != nil {
+		return fmt.Errorf("extractArchive: %w", err)
+	}
+
+	if err := applyDeletions(m, outputFilePath); err != nil {
+		return fmt.Errorf("extractArchive: error removing deleted files: %w", err)
+	}
+
+	// Modification times of directories are only restored after all files
+	// have been written or removed as this would update them again.
+	for _, header := range dirs {
+		if err := os.Chtimes(header.Name, time.Now(), header.ModTime); err != nil {
+			return fmt.Errorf("extractArchive: error setting modification time of %s: %w", header.Name, err)
+		}
+	}
+
+	names := make([]string, 0, len(skipped))
+	for name := range skipped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		warn(
+			"Skipped restoring extended attribute %s of %d file(s), as it is not supported or not permitted: %v",
+			name, skipped[name].files, skipped[name].err,
+		)
+	}
+
+	return nil
+}
+
+// skippedXattr describes an extended attribute that could not be restored.
+type skippedXattr struct {
+	files int
+	err   error
+}
+
+// checkSymlinks returns an error in case any of the path components of target
+// below root is a symlink. Components that do not exist yet are fine, as they
+// are created as directories.
+func checkSymlinks(root, target string) error {
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("checkSymlinks: %s is not contained in %s", target, root)
+	}
+	if rel == "." {
+		return nil
+	}
+	current := root
+	for _, component := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, component)
+		fi, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("checkSymlinks: error calling Lstat on %s: %w", current, err)
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("checkSymlinks: %s is a symlink", current)
+		}
+	}
+	return nil
+}
+
+func extractTarEntry(header *tar.Header, tarReader *tar.Reader, target string, metadata bool, skipped map[string]*skippedXattr) error {
+	mode := header.FileInfo().Mode()
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, mode.Perm()); err != nil {
+			return fmt.Errorf("extractTarEntry: error creating directory: %w", err)
+		}
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("extractTarEntry: error creating parent directory: %w", err)
+		}
+		if err := remove(target); err != nil {
+			return fmt.Errorf("extractTarEntry: error removing existing file: %w", err)
+		}
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return fmt.Errorf("extractTarEntry: error creating file: %w", err)
+		}
+		if metadata && isSparse(header) {
+			if err := copySparse(file, tarReader, header.Size); err != nil {
+				file.Close()
+				return fmt.Errorf("extractTarEntry: error writing sparse file: %w", err)
+			}
+		} else if _, err := io.Copy(file, tarReader); err != nil {
+			file.Close()
+			return fmt.Errorf("extractTarEntry: error writing file: %w", err)
+		}
+		if err := file.Close(); err != nil {
+			return fmt.Errorf("extractTarEntry: error closing file: %w", err)
+		}
+	case tar.TypeSymlink:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("extractTarEntry: error creating parent directory: %w", err)
+		}
+		if err := remove(target); err != nil {
+			return fmt.Errorf("extractTarEntry: error removing existing file: %w", err)
+		}
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			return fmt.Errorf("extractTarEntry: error creating symlink: %w", err)
+		}
+	case tar.TypeLink:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("extractTarEntry: error creating parent directory: %w", err)
+		}
+		if err := remove(target); err != nil {
+			return fmt.Errorf("extractTarEntry: error removing existing file: %w", err)
+		}
+		if err := os.Link(header.Linkname, target); err != nil {
+			return fmt.Errorf("extractTarEntry: error creating hard link: %w", err)
+		}
+		// Hard links share their metadata with the file they point to, which
+		// has already been restored.
+		return nil
+	default:
+		return nil
+	}
+
+	if err := os.Lchown(target, header.Uid, header.Gid); err != nil {
+		return fmt.Errorf("extractTarEntry: error setting ownership: %w", err)
+	}
+	if header.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	if err := os.Chmod(target, mode); err != nil {
+		return fmt.Errorf("extractTarEntry: error setting permissions: %w", err)
+	}
+	// Extended attributes are applied after ownership and permissions, as
+	// changing these would affect ACLs and capabilities otherwise.
+	if metadata {
+		skippedXattrs, err := applyXattrs(target, headerXattrs(header))
+		if err != nil {
+			return fmt.Errorf("extractTarEntry: error setting extended attributes: %w", err)
+		}
+		for name, err := range skippedXattrs {
+			if skipped[name] == nil {
+				skipped[name] = &skippedXattr{err: err}
+			}
+			skipped[name].files++
+		}
+	}
+	if err := os.Chtimes(target, time.Now(), header.ModTime); err != nil {
+		return fmt.Errorf("extractTarEntry: error setting modification time: %w", err)
+	}
+	return nil
+}
+
+// inspectArchive reads the (compressed) tar archive from the given reader in full
+// without writing anything to disk, returning the number of entries and the
+// total size of their contents. Any kind of corruption results in an error.
+func inspectArchive(r io.Reader) (uint, uint64, error) {
+	decompressionReader, err := newDecompressionReader(r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("inspectArchive: error creating decompression reader: %w", err)
+	}
+	defer decompressionReader.Close()
+	tarReader := tar.NewReader(decompressionReader)
+
+	var entries uint
+	var size uint64
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entries, size, fmt.Errorf("inspectArchive: error reading tar header after %d entries: %w", entries, err)
+		}
+		n, err := io.Copy(io.Discard, tarReader)
+		if err != nil {
+			return entries, size, fmt.Errorf("inspectArchive: error reading contents of %s: %w", header.Name, err)
+		}
+		entries++
+		size += uint64(n)
+	}
+
+	if err := drain(decompressionReader); err != nil {
+		return entries, size, fmt.Errorf("inspectArchive: %w", err)
+	}
+	return entries, size, nil
+}
+
+// drain reads the given reader until EOF. Readers for compressed or encrypted
+// data check their integrity only when reaching the end of their input, which
+// is not necessarily the case when the end of the tar archive has been read.
+func drain(r io.Reader) error {
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("drain: error reading trailing data: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+
+	"github.com/cosiner/argv"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+const (
+	archiveStreamLabel         = "docker-volume-backup.archive-stream"
+	archiveStreamFilenameLabel = "docker-volume-backup.archive-stream-filename"
+	archiveStreamSourceLabel   = "docker-volume-backup.archive-stream-source"
+)
+
+// capturedOutput is the output of a command run in a container labeled with
+// `docker-volume-backup.archive-stream` or `docker-volume-backup.database`.
+// Commands are run while the archive is being written, so their output is
+// streamed into the archive without being stored anywhere else.
+type capturedOutput struct {
+	// name is the name of the entry relative to the root of the archive.
+	name string
+	// source is the backup source the entry is added to.
+	source string
+	// run runs the command, writing its stdout to the given writer.
+	run func(stdout io.Writer) error
+}
+
+// resolveCapturedOutputs resolves the commands of all containers labeled with
+// `docker-volume-backup.archive-stream` as well as the dump tools of all
+// containers labeled with `docker-volume-backup.database`, so they can be run
+// when writing the archive. Resolving them upfront makes configuration errors
+// fail the backup before any containers are stopped.
+func (s *script) resolveCapturedOutputs() error {
+	if s.cli == nil {
+		return nil
+	}
+
+	streams, err := s.labeledContainers(archiveStreamLabel)
+	if err != nil {
+		return fmt.Errorf("resolveCapturedOutputs: %w", err)
+	}
+	databases, err := s.labeledContainers(databaseLabel)
+	if err != nil {
+		return fmt.Errorf("resolveCapturedOutputs: %w", err)
+	}
+	containers := append(streams, databases...)
+
+	stopLabel := "docker-volume-backup.stop-during-backup"
+	outputs := make([]capturedOutput, len(containers))
+	for i, c := range containers {
+		containerName := strings.TrimPrefix(c.Names[0], "/")
+		// Commands are run while the archive is written, which is when
+		// labeled containers are stopped.
+		if value, ok := c.Labels[stopLabel]; ok && value == s.c.BackupStopContainerLabel {
+			return fmt.Errorf(
+				"resolveCapturedOutputs: container %s cannot be labeled %s=%s, as commands are run in it while writing the archive",
+				containerName, stopLabel, value,
+			)
+		}
+		var cmd []string
+		var name, description string
+		if i < len(streams) {
+			if _, ok := c.Labels[databaseLabel]; ok {
+				return fmt.Errorf(
+					"resolveCapturedOutputs: container %s cannot use both %s and %s labels",
+					containerName, archiveStreamLabel, databaseLabel,
+				)
+			}
+			args, err := argv.Argv(c.Labels[archiveStreamLabel], nil, nil)
+			if err == nil && len(args) == 0 {
+				err = errors.New("command is empty")
+			}
+			if err != nil {
+				return fmt.Errorf("resolveCapturedOutputs: container %s: error parsing command: %w", containerName, err)
+			}
+			cmd = args[0]
+			name = captureFilename(c, containerName+".out")
+			description = fmt.Sprintf("Running %s command %s for container %s", archiveStreamLabel, c.Labels[archiveStreamLabel], containerName)
+		} else {
+			provider, err := databaseProviderFor(c)
+			if err != nil {
+				return fmt.Errorf("resolveCapturedOutputs: container %s: %w", containerName, err)
+			}
+			cmd = []string{"/bin/sh", "-c", provider.dump}
+			name = captureFilename(c, containerName+"."+provider.extension)
+			description = fmt.Sprintf("Dumping %s database of container %s", c.Labels[databaseLabel], containerName)
+		}
+		source, err := s.captureSource(c.Labels[archiveStreamSourceLabel])
+		if err != nil {
+			return fmt.Errorf("resolveCapturedOutputs: container %s: %w", containerName, err)
+		}
+
+		containerID := c.ID
+		outputs[i] = capturedOutput{name: name, source: source, run: func(stdout io.Writer) error {
+			s.logger.Info(description)
+			var stderr bytes.Buffer
+			err := s.execArgs(containerID, cmd, nil, stdout, &stderr)
+			if s.c.ExecForwardOutput {
+				s.forwardOutput(nil, stderr.Bytes())
+			}
+			if err != nil {
+				return fmt.Errorf(
+					"error executing command for container %s: %w",
+					containerName, execError(err, stderr.Bytes()),
+				)
+			}
+			return nil
+		}}
+	}
+
+	s.captured = outputs
+	return nil
+}
+
+// labeledContainers returns all containers carrying the given label, taking
+// EXEC_LABEL into account.
+func (s *script) labeledContainers(label string) ([]types.Container, error) {
+	f := []filters.KeyValuePair{
+		{Key: "label", Value: label},
+	}
+	if s.c.ExecLabel != "" {
+		f = append(f, filters.KeyValuePair{
+			Key:   "label",
+			Value: fmt.Sprintf("docker-volume-backup.exec-label=%s", s.c.ExecLabel),
+		})
+	}
+	containers, err := s.cli.ContainerList(context.Background(), types.ContainerListOptions{
+		Quiet:   true,
+		Filters: filters.NewArgs(f...),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("labeledContainers: error querying for containers: %w", err)
+	}
+	return containers, nil
+}
+
+// captureSource returns the backup source captured output is added to. When
+// archiving each source on its own, the source needs to be given by name.
+func (s *script) captureSource(name string) (string, error) {
+	if !s.perSource() {
+		return s.c.BackupSources, nil
+	}
+	for _, src := range s.sources {
+		if src.name == name {
+			return src.path, nil
+		}
+	}
+	return "", fmt.Errorf(
+		"captureSource: label %s needs to name one of the backup sources when BACKUP_PER_SOURCE is set, got `%s`",
+		archiveStreamSourceLabel, name,
+	)
+}
+
+// capturedFor returns all captured output that is to be added to the archive
+// of the currently configured backup sources.
+func (s *script) capturedFor() []capturedOutput {
+	var result []capturedOutput
+	for _, output := range s.captured {
+		if output.source == s.c.BackupSources {
+			result = append(result, output)
+		}
+	}
+	return result
+}
+
+// writeCapturedOutput runs the command of the given captured output and adds
+// its output to the archive, placing it relative to the given root of the
+// archive.
+func writeCapturedOutput(output capturedOutput, aw *archiveWriter, root string) error {
+	w := &chunkedEntryWriter{
+		tw:      aw.tw,
+		name:    path.Join(root, output.name),
+		modTime: aw.generatedModTime(),
+	}
+	if err := output.run(w); err != nil {
+		return fmt.Errorf("writeCapturedOutput: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("writeCapturedOutput: %w", err)
+	}
+	return nil
+}
+
+// captureChunkSize is the amount of captured output that is held in memory
+// before being written to the archive.
+const captureChunkSize = 32 << 20
+
+// chunkedEntryWriter writes all data written to it to the given tar writer.
+// As the size of an entry needs to be known before writing it, data is held in
+// memory until captureChunkSize bytes have been written. In case all data fits
+// into a single chunk, it is written as a single entry of the given name.
+// Otherwise each chunk is written as an entry of its own, named after the
+// given name followed by `.part000`, `.part001` and so on.
+type chunkedEntryWriter struct {
+	tw      *tar.Writer
+	name    string
+	modTime time.Time
+	buf     []byte
+	index   int
+}
+
+func (w *chunkedEntryWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) != 0 {
+		// A chunk is only written once more data follows, so it is known
+		// whether the output needs to be split.
+		if len(w.buf) == captureChunkSize {
+			if err := w.writeEntry(storage.PartName(w.name, w.index)); err != nil {
+				return written, err
+			}
+			w.index++
+		}
+		n := captureChunkSize - len(w.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes all data that is still held in memory to the archive.
+func (w *chunkedEntryWriter) Close() error {
+	if w.index == 0 {
+		return w.writeEntry(w.name)
+	}
+	return w.writeEntry(storage.PartName(w.name, w.index))
+}
+
+func (w *chunkedEntryWriter) writeEntry(name string) error {
+	if err := w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(w.buf)),
+		Mode:     0644,
+		ModTime:  w.modTime,
+	}); err != nil {
+		return fmt.Errorf("writeEntry: error writing header: %w", err)
+	}
+	if _, err := w.tw.Write(w.buf); err != nil {
+		return fmt.Errorf("writeEntry: error writing contents: %w", err)
+	}
+	w.buf = w.buf[:0]
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// reproducible returns whether archives are created in a deterministic way,
+// which is required for skipping unchanged backups.
+func (s *script) reproducible() bool {
+	return s.c.BackupReproducible || s.c.BackupSkipUnchanged
+}
+
+// validateReproducible checks the configuration for creating reproducible
+// archives.
+func (s *script) validateReproducible() error {
+	if !s.reproducible() {
+		return nil
+	}
+	if s.c.BackupFormat == formatRepository {
+		return errors.New("validateReproducible: BACKUP_REPRODUCIBLE and BACKUP_SKIP_UNCHANGED cannot be used when BACKUP_FORMAT is repository")
+	}
+	if s.c.BackupSkipUnchanged && (s.c.BackupStream || s.c.BackupIncremental) {
+		return errors.New("validateReproducible: BACKUP_SKIP_UNCHANGED cannot be used when BACKUP_STREAM or BACKUP_INCREMENTAL is set")
+	}
+	if s.c.BackupSkipUnchanged && s.newChecksumHash() == nil {
+		return errors.New("validateReproducible: BACKUP_SKIP_UNCHANGED requires GPG_PASSPHRASE or AGE_PASSPHRASE when encrypting backups")
+	}
+	return nil
+}
+
+// newChecksumHash returns the hash checksums of archives are computed with.
+// Checksums describe the unencrypted archive, so a plain SHA-256 stored next
+// to an encrypted backup would allow anyone with access to the storage to
+// confirm guesses about its contents. When encrypting using a passphrase, an
+// HMAC keyed with the passphrase is used instead. When encrypting using public
+// keys only, there is no secret to key it with, so nil is returned and no
+// checksum is stored.
+func (s *script) newChecksumHash() hash.Hash {
+	for _, passphrase := range []string{s.c.GpgPassphrase, s.c.AgePassphrase} {
+		if passphrase != "" {
+			return hmac.New(sha256.New, []byte(passphrase))
+		}
+	}
+	if s.encrypts() {
+		return nil
+	}
+	return sha256.New()
+}
+
+// fileChecksum returns the contents of the checksum file for the file at the
+// given location, using the given hash.
+func fileChecksum(file string, h hash.Hash) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("fileChecksum: error opening file: %w", err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("fileChecksum: error hashing file: %w", err)
+	}
+	return formatChecksum(h.Sum(nil), path.Base(file)), nil
+}
+
+// formatChecksum formats the given sum like `sha256sum` does. The name is
+// always the one of the unencrypted archive, as encryption is not
+// reproducible.
+func formatChecksum(sum []byte, name string) string {
+	return fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum), name)
+}
+
+// parseChecksum returns the hex encoded sum contained in the given checksum
+// file.
+func parseChecksum(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("parseChecksum: error reading checksum: %w", err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", errors.New("parseChecksum: checksum file is empty")
+	}
+	return fields[0], nil
+}
+
+// putChecksum stores the checksum of the current archive next to the backup
+// of the given name in the given storage.
+func (s *script) putChecksum(backend storage.Backend, name string) error {
+	if s.checksum == "" {
+		return nil
+	}
+	if err := backend.Put(name+storage.ChecksumSuffix, strings.NewReader(s.checksum)); err != nil {
+		return fmt.Errorf("putChecksum: error storing checksum in storage %s: %w", backend.Name(), err)
+	}
+	return nil
+}
+
+// unchangedIn returns whether the most recent backup in the given storage has
+// the same checksum as the current archive, in which case uploading it again
+// can be skipped. Backups that are about to be pruned are never considered
+// unchanged, so that skipping uploads cannot cause all backups to be pruned.
+func (s *script) unchangedIn(backend storage.Backend) (bool, error) {
+	if !s.c.BackupSkipUnchanged || s.checksum == "" {
+		return false, nil
+	}
+	backups, err := backend.List(s.c.BackupPruningPrefix)
+	if err != nil {
+		return false, fmt.Errorf("unchangedIn: error listing backups in storage %s: %w", backend.Name(), err)
+	}
+
+	var latest *storage.Backup
+	grouped := storage.Group(backups)
+	for i, backup := range grouped {
+		if latest == nil || backup.LastModified.After(latest.LastModified) {
+			latest = &grouped[i]
+		}
+	}
+	if latest == nil || !hasSidecar(*latest, storage.ChecksumSuffix) {
+		return false, nil
+	}
+	if s.c.BackupRetentionDays >= 0 && latest.LastModified.Before(s.pruningDeadline()) {
+		return false, nil
+	}
+
+	r, err := backend.Open(latest.Name + storage.ChecksumSuffix)
+	if err != nil {
+		return false, fmt.Errorf("unchangedIn: error opening checksum of %s: %w", latest.Name, err)
+	}
+	defer r.Close()
+	previous, err := parseChecksum(r)
+	if err != nil {
+		return false, fmt.Errorf("unchangedIn: %w", err)
+	}
+	current, err := parseChecksum(strings.NewReader(s.checksum))
+	if err != nil {
+		return false, fmt.Errorf("unchangedIn: %w", err)
+	}
+	if previous != current {
+		return false, nil
+	}
+	s.logger.Infof("Backup `%s` in storage %s has the same contents, skipping upload.", latest.Name, backend.Name())
+	return true, nil
+}
+
+// hasSidecar returns whether a sidecar with the given suffix is stored next to
+// the given backup.
+func hasSidecar(backup storage.Backup, suffix string) bool {
+	for _, sidecar := range backup.Sidecars {
+		if sidecar == backup.Name+suffix {
+			return true
+		}
+	}
+	return false
+}
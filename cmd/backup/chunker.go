@@ -0,0 +1,92 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	chunkMinSize = 512 << 10
+	chunkMaxSize = 8 << 20
+	// Cutting a chunk whenever the lowest 20 bits of the fingerprint are
+	// zero results in chunks of about 1MiB on average.
+	chunkMask = 1<<20 - 1
+)
+
+// gearTable maps each byte to a pseudo random value used for computing the
+// rolling fingerprint. It needs to be stable across releases, as changing it
+// would change all chunk boundaries and defeat deduplication.
+var gearTable = func() (table [256]uint64) {
+	for i := range table {
+		sum := sha256.Sum256([]byte{byte(i)})
+		table[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return
+}()
+
+// chunker splits the data read from r into chunks using content-defined
+// chunking. As chunk boundaries depend on the data only, inserting or removing
+// data only changes the chunks around the modification, while all others stay
+// the same and can be deduplicated.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	// length is the number of bytes in buf that have been read, offset is the
+	// number of bytes at the start of buf that have been returned already.
+	length, offset int
+	eof            bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{
+		r:   r,
+		buf: make([]byte, chunkMaxSize),
+	}
+}
+
+// next returns the next chunk. The returned slice is only valid until the
+// next call. io.EOF is returned once all data has been read.
+func (c *chunker) next() ([]byte, error) {
+	// Data following the previous chunk is moved to the start of the buffer,
+	// which is then filled up so it holds at least one full chunk.
+	c.length = copy(c.buf, c.buf[c.offset:c.length])
+	c.offset = 0
+	for !c.eof && c.length < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.length:])
+		c.length += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, fmt.Errorf("next: error reading data: %w", err)
+		}
+	}
+	if c.length == 0 {
+		return nil, io.EOF
+	}
+	c.offset = cutChunk(c.buf[:c.length])
+	return c.buf[:c.offset], nil
+}
+
+// cutChunk returns the length of the chunk at the start of the given data,
+// which holds at most chunkMaxSize bytes.
+func cutChunk(data []byte) int {
+	if len(data) <= chunkMinSize {
+		return len(data)
+	}
+	// Each byte is shifted out of the fingerprint once 64 more bytes have
+	// been added, so the fingerprint only depends on a rolling window of the
+	// last 64 bytes and bytes before that window do not need to be hashed.
+	var fingerprint uint64
+	for i := chunkMinSize - 64; i < len(data); i++ {
+		fingerprint = (fingerprint << 1) + gearTable[data[i]]
+		if i+1 >= chunkMinSize && fingerprint&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
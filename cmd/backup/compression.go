@@ -0,0 +1,180 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression is the algorithm used for compressing archives.
+type Compression string
+
+const (
+	compressionGzip Compression = "gz"
+	compressionZstd Compression = "zst"
+	compressionXz   Compression = "xz"
+	compressionNone Compression = "none"
+)
+
+func (c *Compression) Decode(v string) error {
+	switch v {
+	case "gz", "gzip":
+		*c = compressionGzip
+	case "zst", "zstd":
+		*c = compressionZstd
+	case "xz":
+		*c = compressionXz
+	case "none":
+		*c = compressionNone
+	default:
+		return fmt.Errorf("config: unknown compression type `%s`, expected one of gz, zst, xz or none", v)
+	}
+	return nil
+}
+
+// extension returns the file extension of archives using the compression type.
+func (c Compression) extension() string {
+	if c == compressionNone {
+		return ".tar"
+	}
+	return ".tar." + string(c)
+}
+
+var archiveExtensions = []string{".tar.gz", ".tgz", ".tar.zst", ".tar.xz", ".tar"}
+
+// withArchiveExtension replaces any known archive extension of the given
+// filename with the extension matching the given compression type. Filenames
+// using other extensions are returned as is.
+func withArchiveExtension(filename string, c Compression) string {
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(filename, ext) {
+			return strings.TrimSuffix(filename, ext) + c.extension()
+		}
+	}
+	return filename
+}
+
+// validateCompression checks the configured compression level and number of
+// workers, so invalid values are reported before any containers are stopped
+// instead of when writing the archive.
+func (s *script) validateCompression() error {
+	if s.c.BackupCompression == compressionXz && s.c.BackupCompressionWorkers != 1 {
+		return errors.New("validateCompression: BACKUP_COMPRESSION_WORKERS cannot be used when BACKUP_COMPRESSION is xz")
+	}
+	level := s.c.BackupCompressionLevel
+	if level == 0 {
+		return nil
+	}
+	switch s.c.BackupCompression {
+	case compressionGzip:
+		if level < gzip.BestSpeed || level > gzip.BestCompression {
+			return fmt.Errorf("validateCompression: BACKUP_COMPRESSION_LEVEL needs to be between 1 and 9 when BACKUP_COMPRESSION is gz, got %d", level)
+		}
+	case compressionZstd:
+		if level < 1 || level > 22 {
+			return fmt.Errorf("validateCompression: BACKUP_COMPRESSION_LEVEL needs to be between 1 and 22 when BACKUP_COMPRESSION is zst, got %d", level)
+		}
+	default:
+		return fmt.Errorf("validateCompression: BACKUP_COMPRESSION_LEVEL cannot be used when BACKUP_COMPRESSION is %s", s.c.BackupCompression)
+	}
+	return nil
+}
+
+// newCompressionWriter wraps the given writer so that all data written is
+// compressed using the given compression type. A level of 0 uses the default
+// level of the algorithm. In case concurrency is bigger than 1, blocks of data
+// are compressed in parallel using the given number of workers, which is not
+// supported for xz. The returned writer needs to be closed in order to flush
+// all pending data.
+func newCompressionWriter(w io.Writer, c Compression, level, concurrency int) (io.WriteCloser, error) {
+	if concurrency < 1 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+
+	switch c {
+	case compressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if concurrency == 1 {
+			return gzip.NewWriterLevel(w, level)
+		}
+		// pgzip compresses blocks independently of each other, but still
+		// creates a single gzip stream that can be read by any gzip reader.
+		gzipWriter, err := pgzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, fmt.Errorf("newCompressionWriter: error creating parallel gzip writer: %w", err)
+		}
+		if err := gzipWriter.SetConcurrency(1<<20, concurrency); err != nil {
+			return nil, fmt.Errorf("newCompressionWriter: error setting concurrency: %w", err)
+		}
+		return gzipWriter, nil
+	case compressionZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(concurrency)}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	case compressionXz:
+		return xz.NewWriter(w)
+	case compressionNone:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("newCompressionWriter: unknown compression type %s", c)
+	}
+}
+
+var (
+	magicGzip = []byte{0x1f, 0x8b}
+	magicZstd = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicXz   = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+)
+
+// newDecompressionReader wraps the given reader so that it yields the
+// decompressed data. The compression type is detected by looking at the
+// first bytes of the input, data that is not compressed using any of the
+// supported algorithms is returned as is.
+func newDecompressionReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(magicXz))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("newDecompressionReader: error reading header: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, magicGzip):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, magicZstd):
+		decoder, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("newDecompressionReader: error creating zstd reader: %w", err)
+		}
+		return decoder.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, magicXz):
+		xzReader, err := xz.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("newDecompressionReader: error creating xz reader: %w", err)
+		}
+		return io.NopCloser(xzReader), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -4,13 +4,20 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"os"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/kelseyhightower/envconfig"
 )
 
 // Config holds all configuration values that are expected to be set
-// by users.
+// by users. Fields tagged as sensitive are redacted from notifications and
+// log output.
 type Config struct {
 	AwsS3BucketName            string        `split_words:"true"`
 	AwsS3Path                  string        `split_words:"true"`
@@ -18,11 +25,14 @@ type Config struct {
 	AwsEndpointProto           string        `split_words:"true" default:"https"`
 	AwsEndpointInsecure        bool          `split_words:"true"`
 	AwsStorageClass            string        `split_words:"true"`
-	AwsAccessKeyID             string        `envconfig:"AWS_ACCESS_KEY_ID"`
-	AwsSecretAccessKey         string        `split_words:"true"`
+	AwsAccessKeyID             string        `envconfig:"AWS_ACCESS_KEY_ID" sensitive:"true"`
+	AwsSecretAccessKey         string        `split_words:"true" sensitive:"true"`
 	AwsIamRoleEndpoint         string        `split_words:"true"`
 	BackupSources              string        `split_words:"true" default:"/backup"`
 	BackupFilename             string        `split_words:"true" default:"backup-%Y-%m-%dT%H-%M-%S.tar.gz"`
+	BackupCompression          Compression   `split_words:"true" default:"gz"`
+	BackupCompressionLevel     int           `split_words:"true"`
+	BackupCompressionWorkers   int           `split_words:"true" default:"1"`
 	BackupFilenameExpand       bool          `split_words:"true"`
 	BackupLatestSymlink        string        `split_words:"true"`
 	BackupArchive              string        `split_words:"true" default:"/archive"`
@@ -32,32 +42,93 @@ type Config struct {
 	BackupStopContainerLabel   string        `split_words:"true" default:"true"`
 	BackupFromSnapshot         bool          `split_words:"true"`
 	BackupExcludeRegexp        RegexpDecoder `split_words:"true"`
-	GpgPassphrase              string        `split_words:"true"`
-	NotificationURLs           []string      `envconfig:"NOTIFICATION_URLS"`
+	BackupIncludeGlobs         []string      `split_words:"true"`
+	BackupExcludeGlobs         []string      `split_words:"true"`
+	BackupVerify               bool          `split_words:"true"`
+	BackupStream               bool          `split_words:"true"`
+	BackupStagingDirectory     string        `split_words:"true" default:"/tmp"`
+	BackupSkipSpaceCheck       bool          `split_words:"true"`
+	BackupSplitSize            ByteSize      `split_words:"true"`
+	BackupIncremental          bool          `split_words:"true"`
+	BackupFullIntervalDays     int           `split_words:"true" default:"7"`
+	BackupManifestFile         string        `split_words:"true" default:"/var/lib/docker-volume-backup/manifest.json"`
+	BackupFormat               Format        `split_words:"true" default:"archive"`
+	BackupPreserveMetadata     bool          `split_words:"true" default:"false"`
+	BackupSqliteOnlineBackup   bool          `split_words:"true" default:"false"`
+	BackupReproducible         bool          `split_words:"true"`
+	BackupSkipUnchanged        bool          `split_words:"true"`
+	BackupPerSource            bool          `split_words:"true"`
+	BackupPerSourcePaths       []string      `split_words:"true"`
+	BackupVolumeLabel          string        `split_words:"true"`
+	BackupVolumeHelperImage    string        `split_words:"true" default:"alpine:latest"`
+	GpgPassphrase              string        `split_words:"true" sensitive:"true"`
+	GpgPublicKeyRing           string        `split_words:"true"`
+	GpgPrivateKeyRing          string        `split_words:"true"`
+	GpgPrivateKeyPassphrase    string        `split_words:"true" sensitive:"true"`
+	AgePassphrase              string        `split_words:"true" sensitive:"true"`
+	AgePublicKeys              []string      `split_words:"true"`
+	AgeIdentities              string        `split_words:"true"`
+	GpgSigningKey              string        `split_words:"true"`
+	GpgSigningKeyPassphrase    string        `split_words:"true" sensitive:"true"`
+	GpgVerificationKeyRing     string        `split_words:"true"`
+	NotificationURLs           []string      `envconfig:"NOTIFICATION_URLS" sensitive:"true"`
 	NotificationLevel          string        `split_words:"true" default:"error"`
 	EmailNotificationRecipient string        `split_words:"true"`
 	EmailNotificationSender    string        `split_words:"true" default:"noreply@nohost"`
 	EmailSMTPHost              string        `envconfig:"EMAIL_SMTP_HOST"`
 	EmailSMTPPort              int           `envconfig:"EMAIL_SMTP_PORT" default:"587"`
 	EmailSMTPUsername          string        `envconfig:"EMAIL_SMTP_USERNAME"`
-	EmailSMTPPassword          string        `envconfig:"EMAIL_SMTP_PASSWORD"`
+	EmailSMTPPassword          string        `envconfig:"EMAIL_SMTP_PASSWORD" sensitive:"true"`
 	WebdavUrl                  string        `split_words:"true"`
 	WebdavUrlInsecure          bool          `split_words:"true"`
 	WebdavPath                 string        `split_words:"true" default:"/"`
 	WebdavUsername             string        `split_words:"true"`
-	WebdavPassword             string        `split_words:"true"`
+	WebdavPassword             string        `split_words:"true" sensitive:"true"`
 	SSHHostName                string        `split_words:"true"`
 	SSHPort                    string        `split_words:"true" default:"22"`
 	SSHUser                    string        `split_words:"true"`
-	SSHPassword                string        `split_words:"true"`
+	SSHPassword                string        `split_words:"true" sensitive:"true"`
 	SSHIdentityFile            string        `split_words:"true" default:"/root/.ssh/id_rsa"`
-	SSHIdentityPassphrase      string        `split_words:"true"`
+	SSHIdentityPassphrase      string        `split_words:"true" sensitive:"true"`
 	SSHRemotePath              string        `split_words:"true"`
 	ExecLabel                  string        `split_words:"true"`
 	ExecForwardOutput          bool          `split_words:"true"`
 	LockTimeout                time.Duration `split_words:"true" default:"60m"`
 }
 
+// fileSuffix is appended to the name of any configuration variable to name
+// the variable holding the location of a file the value is read from.
+const fileSuffix = "_FILE"
+
+// loadFileValues sets all configuration variables that have a `_FILE`
+// variant to the contents of the file it points to, which allows passing
+// values as Docker secrets. Setting both variants is an error.
+func loadFileValues(c *Config) error {
+	var keys bytes.Buffer
+	if err := envconfig.Usagef("", c, &keys, "{{range .}}{{usage_key .}}\n{{end}}"); err != nil {
+		return fmt.Errorf("loadFileValues: error listing configuration variables: %w", err)
+	}
+	for _, key := range strings.Fields(keys.String()) {
+		location, ok := os.LookupEnv(key + fileSuffix)
+		if !ok {
+			continue
+		}
+		if _, ok := os.LookupEnv(key); ok {
+			return fmt.Errorf("loadFileValues: %s and %s cannot be set at the same time", key, key+fileSuffix)
+		}
+		data, err := os.ReadFile(location)
+		if err != nil {
+			return fmt.Errorf("loadFileValues: error reading %s: %w", key+fileSuffix, err)
+		}
+		// Trailing newlines are added by most editors and are not
+		// considered to be part of the value.
+		if err := os.Setenv(key, strings.TrimRight(string(data), "\r\n")); err != nil {
+			return fmt.Errorf("loadFileValues: error setting %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
 type RegexpDecoder struct {
 	Re *regexp.Regexp
 }
@@ -73,3 +144,36 @@ func (r *RegexpDecoder) Decode(v string) error {
 	*r = RegexpDecoder{Re: re}
 	return nil
 }
+
+// ByteSize is an amount of bytes that can be given using units like
+// `500MB` (powers of 1000) or `2GiB` (powers of 1024).
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+func (b *ByteSize) Decode(v string) error {
+	if v == "" {
+		return nil
+	}
+	value, multiplier := strings.TrimSpace(v), int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("config: error parsing size `%s`, expected values like 500MB or 2GiB", v)
+	}
+	*b = ByteSize(n * multiplier)
+	return nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+
+	"github.com/docker/docker/api/types"
+)
+
+const databaseLabel = "docker-volume-backup.database"
+
+// databaseProvider describes how to dump and restore a database using the
+// tools that ship with the database's image. Both scripts are run using
+// `/bin/sh -c` inside the database container, so they can read credentials
+// from the environment variables the official images are configured with.
+type databaseProvider struct {
+	// extension is appended to the name of the container to name the dump
+	// in the archive.
+	extension string
+	// dump writes a dump of all databases to stdout.
+	dump string
+	// restore reads a dump created by dump from stdin.
+	restore string
+	// restart signals the container has to be restarted for the restored
+	// dump to be loaded.
+	restart bool
+}
+
+const mysqlCredentials = `export MYSQL_PWD="${MARIADB_ROOT_PASSWORD:-$MYSQL_ROOT_PASSWORD}"; `
+
+const mongodbCredentials = `${MONGO_INITDB_ROOT_USERNAME:+--username "$MONGO_INITDB_ROOT_USERNAME" --password "$MONGO_INITDB_ROOT_PASSWORD" --authenticationDatabase admin}`
+
+const redisCredentials = `[ -n "$REDIS_PASSWORD" ] && export REDISCLI_AUTH="$REDIS_PASSWORD"; `
+
+var databaseProviders = map[string]databaseProvider{
+	"postgres": {
+		extension: "sql",
+		dump:      `exec pg_dumpall --clean --if-exists -U "${POSTGRES_USER:-postgres}"`,
+		// pg_dumpall --clean drops and creates all roles, which fails for the
+		// role psql is connected as. These statements are removed from the
+		// dump, so any other error aborts the restore.
+		restore: `user="${POSTGRES_USER:-postgres}"; ` +
+			`sed -e "/^DROP ROLE IF EXISTS $user;\$/d" -e "/^CREATE ROLE $user;\$/d" | ` +
+			`psql -X -q -v ON_ERROR_STOP=1 -U "$user" -d postgres`,
+	},
+	"mysql": {
+		extension: "sql",
+		dump: mysqlCredentials +
+			`exec "$(command -v mariadb-dump || command -v mysqldump)" -uroot --all-databases --single-transaction --routines --triggers --events`,
+		restore: mysqlCredentials +
+			`exec "$(command -v mariadb || command -v mysql)" -uroot`,
+	},
+	"mongodb": {
+		extension: "archive",
+		dump:      `exec mongodump --quiet --archive ` + mongodbCredentials,
+		restore:   `exec mongorestore --quiet --archive --drop ` + mongodbCredentials,
+	},
+	"redis": {
+		extension: "rdb",
+		// redis-cli cannot write to stdout in all versions, and prints status
+		// messages when writing the dump.
+		dump: redisCredentials +
+			`tmp="$(mktemp)" && redis-cli --rdb "$tmp" >&2 && cat "$tmp"; ` +
+			`status=$?; rm -f "$tmp"; exit $status`,
+		// The running server would overwrite the restored file when saving
+		// its data on shutdown, which is why the container is killed after
+		// moving the file into place.
+		restore: redisCredentials +
+			`dir="$(redis-cli config get dir | tail -n 1)" && ` +
+			`file="$(redis-cli config get dbfilename | tail -n 1)" && ` +
+			`cat > "$dir/.restore-$file" && mv "$dir/.restore-$file" "$dir/$file"`,
+		restart: true,
+	},
+}
+
+func init() {
+	databaseProviders["mariadb"] = databaseProviders["mysql"]
+}
+
+// databaseProviderFor returns the provider selected by the database label
+// of the given container.
+func databaseProviderFor(c types.Container) (databaseProvider, error) {
+	name := c.Labels[databaseLabel]
+	provider, ok := databaseProviders[name]
+	if !ok {
+		var names []string
+		for n := range databaseProviders {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return databaseProvider{}, fmt.Errorf(
+			"databaseProviderFor: unknown database `%s`, expected one of %s",
+			name, strings.Join(names, ", "),
+		)
+	}
+	return provider, nil
+}
+
+// restoreDatabases loads the dumps of all containers labeled with
+// `docker-volume-backup.database` that have been restored into the configured
+// backup sources into the respective database. Dumps missing from the backup
+// are skipped.
+func (s *script) restoreDatabases() error {
+	if s.cli == nil {
+		return nil
+	}
+	containers, err := s.labeledContainers(databaseLabel)
+	if err != nil {
+		return fmt.Errorf("restoreDatabases: %w", err)
+	}
+
+	for _, c := range containers {
+		containerName := strings.TrimPrefix(c.Names[0], "/")
+		provider, err := databaseProviderFor(c)
+		if err != nil {
+			return fmt.Errorf("restoreDatabases: container %s: %w", containerName, err)
+		}
+		// Containers that do not name the restored source are skipped.
+		if source, err := s.captureSource(c.Labels[archiveStreamSourceLabel]); err != nil || source != s.c.BackupSources {
+			continue
+		}
+
+		name := captureFilename(c, containerName+"."+provider.extension)
+		files, err := capturedFiles(s.c.BackupSources, name)
+		if err != nil {
+			return fmt.Errorf("restoreDatabases: %w", err)
+		}
+		if len(files) == 0 {
+			s.logger.Warnf("Backup does not contain a dump `%s` for container %s, skipping.", name, containerName)
+			continue
+		}
+		dump := &partsReader{open: func(name string) (io.ReadCloser, error) {
+			return os.Open(name)
+		}, files: files}
+
+		var stdout, stderr bytes.Buffer
+		err = s.execArgs(c.ID, []string{"/bin/sh", "-c", provider.restore}, dump, &stdout, &stderr)
+		dump.Close()
+		if s.c.ExecForwardOutput {
+			s.forwardOutput(stdout.Bytes(), stderr.Bytes())
+		}
+		if err != nil {
+			return fmt.Errorf(
+				"restoreDatabases: error restoring %s dump for container %s: %w",
+				c.Labels[databaseLabel], containerName, execError(err, stderr.Bytes()),
+			)
+		}
+
+		if provider.restart {
+			if err := s.cli.ContainerKill(context.Background(), c.ID, "SIGKILL"); err != nil {
+				return fmt.Errorf("restoreDatabases: error stopping container %s: %w", containerName, err)
+			}
+			if err := s.cli.ContainerStart(context.Background(), c.ID, types.ContainerStartOptions{}); err != nil {
+				return fmt.Errorf("restoreDatabases: error starting container %s: %w", containerName, err)
+			}
+		}
+		// The dump is not part of the restored data, so it is not left behind
+		// in BACKUP_SOURCES.
+		for _, file := range files {
+			if err := remove(file); err != nil {
+				return fmt.Errorf("restoreDatabases: error removing dump: %w", err)
+			}
+		}
+		s.logger.Infof("Restored %s dump `%s` into container %s.", c.Labels[databaseLabel], name, containerName)
+	}
+	return nil
+}
+
+// captureFilename returns the name of the file the output captured for the
+// given container is stored at, relative to the root of the archive.
+func captureFilename(c types.Container, fallback string) string {
+	name := strings.TrimPrefix(path.Clean("/"+c.Labels[archiveStreamFilenameLabel]), "/")
+	if name == "" {
+		return fallback
+	}
+	return name
+}
+
+// capturedFiles returns the files the captured output of the given name has
+// been restored to in the given directory. Output exceeding captureChunkSize
+// is stored in parts, which are returned in order. In case the output has not
+// been restored, no files are returned.
+func capturedFiles(dir, name string) ([]string, error) {
+	file := filepath.Join(dir, filepath.FromSlash(name))
+	files := []string{file}
+	if _, err := os.Lstat(file); errors.Is(err, os.ErrNotExist) {
+		files = nil
+		for index := 0; ; index++ {
+			part := storage.PartName(file, index)
+			if _, err := os.Lstat(part); errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			files = append(files, part)
+		}
+	}
+	for _, file := range files {
+		if err := checkSymlinks(dir, file); err != nil {
+			return nil, fmt.Errorf("capturedFiles: refusing to read captured output: %w", err)
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,12 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+// availableSpace is not supported on this platform, so free space is never
+// checked.
+func availableSpace(location string) (uint64, bool, error) {
+	return 0, false, nil
+}
@@ -0,0 +1,22 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// availableSpace returns the number of bytes that can be written to the file
+// system holding the given location.
+func availableSpace(location string) (uint64, bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(location, &stat); err != nil {
+		return 0, false, fmt.Errorf("availableSpace: error getting file system stats for %s: %w", location, err)
+	}
+	// The types of these fields differ between platforms.
+	return uint64(stat.Bavail) * uint64(stat.Bsize), true, nil
+}
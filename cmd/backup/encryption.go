@@ -0,0 +1,112 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	gpgExtension = ".gpg"
+	ageExtension = ".age"
+)
+
+// usesGPG returns whether backups are encrypted using GPG.
+func (s *script) usesGPG() bool {
+	return s.c.GpgPassphrase != "" || s.c.GpgPublicKeyRing != ""
+}
+
+// usesAge returns whether backups are encrypted using age.
+func (s *script) usesAge() bool {
+	return s.c.AgePassphrase != "" || len(s.c.AgePublicKeys) != 0
+}
+
+// encrypts returns whether backups are encrypted, either using a passphrase
+// or public keys.
+func (s *script) encrypts() bool {
+	return s.usesGPG() || s.usesAge()
+}
+
+// canDecrypt returns whether encrypted backups can be decrypted using the
+// given configuration. Backups encrypted using public keys can only be
+// decrypted in case the matching private keys are given.
+func (s *script) canDecrypt() bool {
+	return s.c.GpgPassphrase != "" || s.c.GpgPrivateKeyRing != "" ||
+		s.c.AgePassphrase != "" || s.c.AgeIdentities != ""
+}
+
+// encryptionExtension returns the extension appended to the names of
+// encrypted backups, or an empty string in case backups are not encrypted.
+func (s *script) encryptionExtension() string {
+	switch {
+	case s.usesAge():
+		return ageExtension
+	case s.usesGPG():
+		return gpgExtension
+	default:
+		return ""
+	}
+}
+
+// encryptionPassphrase returns the passphrase backups are encrypted with, or
+// an empty string in case public keys or no encryption is used.
+func (s *script) encryptionPassphrase() string {
+	if s.c.AgePassphrase != "" {
+		return s.c.AgePassphrase
+	}
+	return s.c.GpgPassphrase
+}
+
+// isEncrypted returns whether the backup of the given name has been
+// encrypted.
+func isEncrypted(name string) bool {
+	return strings.HasSuffix(name, gpgExtension) || strings.HasSuffix(name, ageExtension)
+}
+
+// trimEncryptionExtension returns the given name without the extension
+// added by encryption.
+func trimEncryptionExtension(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, ageExtension), gpgExtension)
+}
+
+// loadEncryption validates the encryption configuration and reads the
+// configured keys.
+func (s *script) loadEncryption() error {
+	if s.usesGPG() && s.usesAge() {
+		return errors.New("loadEncryption: GPG and age encryption cannot be used at the same time")
+	}
+	if err := s.loadKeyRings(); err != nil {
+		return fmt.Errorf("loadEncryption: %w", err)
+	}
+	if err := s.loadAgeKeys(); err != nil {
+		return fmt.Errorf("loadEncryption: %w", err)
+	}
+	return nil
+}
+
+// newEncryptionWriter wraps the given writer so that all data written is
+// encrypted using the configured scheme. The returned writer needs to be
+// closed in order to flush all pending data.
+func (s *script) newEncryptionWriter(w io.Writer, filename string) (io.WriteCloser, error) {
+	if s.usesAge() {
+		return s.newAgeWriter(w)
+	}
+	return s.newGPGWriter(w, filename)
+}
+
+// decryptArchive wraps the given reader so that it yields the plaintext of
+// the encrypted backup of the given name. The scheme is derived from the
+// extension of the name.
+func (s *script) decryptArchive(r io.Reader, name string) (io.Reader, error) {
+	if !s.canDecrypt() {
+		return nil, errors.New("decryptArchive: backup is encrypted, but no passphrase, private keys or identities were given")
+	}
+	if strings.HasSuffix(name, ageExtension) {
+		return s.decryptAge(r)
+	}
+	return s.decryptGPG(r)
+}
@@ -10,8 +10,8 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"os"
 	"strings"
 
 	"github.com/cosiner/argv"
@@ -75,6 +75,80 @@ func (s *script) exec(containerRef string, command string) ([]byte, []byte, erro
 	return stdout, stderr, nil
 }
 
+// execArgs runs the command given as a list of arguments in the given
+// container. Unlike exec, it attaches to the command's stdout and passes
+// output to the given writers while the command is running, which is used for
+// streaming captured output into the archive. In case stdin is not nil, it is
+// copied to the command's stdin, which is closed afterwards. Commands exiting
+// before having read all of stdin are considered to have failed.
+func (s *script) execArgs(containerRef string, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	execID, err := s.cli.ContainerExecCreate(context.Background(), containerRef, types.ExecConfig{
+		Cmd:          args,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return fmt.Errorf("execArgs: error creating container exec: %w", err)
+	}
+
+	resp, err := s.cli.ContainerExecAttach(context.Background(), execID.ID, types.ExecStartCheck{})
+	if err != nil {
+		return fmt.Errorf("execArgs: error attaching container exec: %w", err)
+	}
+
+	outputDone := make(chan error)
+	go func() {
+		_, err := stdcopy.StdCopy(stdout, stderr, resp.Reader)
+		outputDone <- err
+	}()
+
+	inputDone := make(chan error, 1)
+	if stdin != nil {
+		go func() {
+			_, err := io.Copy(resp.Conn, stdin)
+			resp.CloseWrite()
+			inputDone <- err
+		}()
+	} else {
+		inputDone <- nil
+	}
+
+	outputErr := <-outputDone
+	// Output is done once the command has exited. Closing the connection
+	// makes copying to stdin fail in case the command has not read all of
+	// it, so waiting for the copy to finish does not block.
+	resp.Close()
+	inputErr := <-inputDone
+	if outputErr != nil {
+		return fmt.Errorf("execArgs: error demultiplexing output: %w", outputErr)
+	}
+
+	res, err := s.cli.ContainerExecInspect(context.Background(), execID.ID)
+	if err != nil {
+		return fmt.Errorf("execArgs: error inspecting container exec: %w", err)
+	}
+
+	if res.ExitCode > 0 {
+		return fmt.Errorf("execArgs: running command exited %d", res.ExitCode)
+	}
+
+	if inputErr != nil {
+		return fmt.Errorf("execArgs: error passing input to command, it might have exited before reading all of it: %w", inputErr)
+	}
+
+	return nil
+}
+
+// execError adds the given stderr output of a failed command to err, so the
+// cause of the failure ends up in logs and notifications.
+func execError(err error, stderr []byte) error {
+	if msg := strings.TrimSpace(string(stderr)); msg != "" {
+		return fmt.Errorf("%w: %s", err, msg)
+	}
+	return err
+}
+
 func (s *script) runLabeledCommands(label string) error {
 	f := []filters.KeyValuePair{
 		{Key: "label", Value: label},
@@ -158,8 +232,7 @@ func (s *script) runLabeledCommands(label string) error {
 			s.logger.Infof("Running %s command %s for container %s", label, cmd, strings.TrimPrefix(c.Names[0], "/"))
 			stdout, stderr, err := s.exec(c.ID, cmd)
 			if s.c.ExecForwardOutput {
-				os.Stderr.Write(stderr)
-				os.Stdout.Write(stdout)
+				s.forwardOutput(stdout, stderr)
 			}
 			if err != nil {
 				return fmt.Errorf("runLabeledCommands: error executing command: %w", err)
@@ -0,0 +1,144 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// armoredKeyPrefix is the beginning of any armored OpenPGP key block. Values
+// of key ring options starting with it are treated as keys instead of
+// locations.
+const armoredKeyPrefix = "-----BEGIN PGP"
+
+// loadKeyRings reads the configured public and private keys.
+func (s *script) loadKeyRings() error {
+	if s.c.GpgPassphrase != "" && s.c.GpgPublicKeyRing != "" {
+		return errors.New("loadKeyRings: GPG_PASSPHRASE and GPG_PUBLIC_KEY_RING cannot be used at the same time")
+	}
+	if s.c.GpgPublicKeyRing != "" {
+		keys, err := readKeyRing(s.c.GpgPublicKeyRing)
+		if err != nil {
+			return fmt.Errorf("loadKeyRings: error reading GPG_PUBLIC_KEY_RING: %w", err)
+		}
+		s.publicKeys = keys
+	}
+	if s.c.GpgPrivateKeyRing != "" {
+		keys, err := readKeyRing(s.c.GpgPrivateKeyRing)
+		if err != nil {
+			return fmt.Errorf("loadKeyRings: error reading GPG_PRIVATE_KEY_RING: %w", err)
+		}
+		s.privateKeys = keys
+	}
+	return nil
+}
+
+// readKeyRing reads armored OpenPGP keys from the given value, which is either
+// an armored key block, the location of a file holding one or the location of
+// a directory of such files.
+func readKeyRing(value string) (openpgp.EntityList, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), armoredKeyPrefix) {
+		keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(value))
+		if err != nil {
+			return nil, fmt.Errorf("readKeyRing: error parsing armored keys: %w", err)
+		}
+		return keys, nil
+	}
+
+	fi, err := os.Stat(value)
+	if err != nil {
+		return nil, fmt.Errorf("readKeyRing: error reading %s: %w", value, err)
+	}
+	files := []string{value}
+	if fi.IsDir() {
+		entries, err := os.ReadDir(value)
+		if err != nil {
+			return nil, fmt.Errorf("readKeyRing: error reading directory %s: %w", value, err)
+		}
+		files = nil
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				files = append(files, filepath.Join(value, entry.Name()))
+			}
+		}
+		sort.Strings(files)
+	}
+
+	var keys openpgp.EntityList
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("readKeyRing: error opening %s: %w", file, err)
+		}
+		entities, err := openpgp.ReadArmoredKeyRing(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("readKeyRing: error parsing armored keys in %s: %w", file, err)
+		}
+		keys = append(keys, entities...)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("readKeyRing: no keys found in %s", value)
+	}
+	return keys, nil
+}
+
+// newGPGWriter wraps the given writer so that all data written is encrypted
+// using the configured GPG passphrase or public keys.
+func (s *script) newGPGWriter(w io.Writer, filename string) (io.WriteCloser, error) {
+	hints := &openpgp.FileHints{
+		IsBinary: true,
+		FileName: filename,
+	}
+	if s.publicKeys != nil {
+		return openpgp.Encrypt(w, s.publicKeys, nil, hints, nil)
+	}
+	return openpgp.SymmetricallyEncrypt(w, []byte(s.c.GpgPassphrase), hints, nil)
+}
+
+// decryptGPG wraps the given reader so that it yields the plaintext of a
+// backup that has been encrypted using the configured GPG passphrase or the
+// public keys matching the configured private keys.
+func (s *script) decryptGPG(r io.Reader) (io.Reader, error) {
+	var prompted bool
+	md, err := openpgp.ReadMessage(r, s.privateKeys, func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		// The prompt is called repeatedly in case the passphrase is wrong, so
+		// it needs to fail on its second invocation.
+		if prompted {
+			return nil, errors.New("decryptGPG: unable to decrypt backup using the given passphrase or private keys")
+		}
+		prompted = true
+		if symmetric {
+			if s.c.GpgPassphrase == "" {
+				return nil, errors.New("decryptGPG: backup has been encrypted using a passphrase, but no GPG_PASSPHRASE was given")
+			}
+			return []byte(s.c.GpgPassphrase), nil
+		}
+		// Private keys protected by a passphrase are decrypted on demand.
+		for _, key := range keys {
+			if key.PrivateKey == nil || !key.PrivateKey.Encrypted {
+				continue
+			}
+			if s.c.GpgPrivateKeyPassphrase == "" {
+				return nil, errors.New("decryptGPG: private key is protected by a passphrase, but no GPG_PRIVATE_KEY_PASSPHRASE was given")
+			}
+			if err := key.PrivateKey.Decrypt([]byte(s.c.GpgPrivateKeyPassphrase)); err != nil {
+				return nil, fmt.Errorf("decryptGPG: error decrypting private key: %w", err)
+			}
+		}
+		return nil, nil
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decryptGPG: error reading encrypted message: %w", err)
+	}
+	return md.UnverifiedBody, nil
+}
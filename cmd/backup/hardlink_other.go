@@ -0,0 +1,16 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// hardLinkID is not supported on this platform, so all files are archived
+// as if they had a single hard link.
+func hardLinkID(fileInfo os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
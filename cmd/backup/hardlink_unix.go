@@ -0,0 +1,21 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// hardLinkID returns the fileID of the given file in case it is a regular
+// file that has more than one hard link.
+func hardLinkID(fileInfo os.FileInfo) (fileID, bool) {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok || !fileInfo.Mode().IsRegular() || stat.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
@@ -0,0 +1,261 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreFileName is the name of files that list paths which are excluded
+// from backups, using the same syntax and semantics as `.gitignore` files.
+const ignoreFileName = ".dockervolumebackupignore"
+
+// ignoreRule is a single pattern of an ignore file or glob list.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// matches returns whether the rule matches the given slash separated path,
+// which is relative to the directory the rule has been defined in.
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	return r.re.MatchString(rel)
+}
+
+// parseIgnorePattern compiles a single line of an ignore file. Blank lines
+// and comments do not yield a rule, which is signaled by returning false.
+func parseIgnorePattern(line string) (ignoreRule, bool, error) {
+	if !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimRight(line, " \t")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false, nil
+	}
+
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// Patterns containing a slash anywhere but at their end are relative to
+	// the directory they are defined in, all others match at any depth.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return ignoreRule{}, false, nil
+	}
+
+	expr := globToRegexp(line)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(?:.*/)?" + expr + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return ignoreRule{}, false, fmt.Errorf("parseIgnorePattern: error compiling pattern %s: %w", line, err)
+	}
+	rule.re = re
+	return rule, true, nil
+}
+
+// globToRegexp translates a glob using gitignore syntax into a regular
+// expression. `*` and `?` do not match slashes, `**` matches any number of
+// directories.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				if i+2 < len(glob) && glob[i+2] == '/' {
+					b.WriteString("(?:.*/)?")
+					i += 2
+				} else {
+					b.WriteString(".*")
+					i++
+				}
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// parseIgnoreRules compiles the given patterns, skipping blank lines and
+// comments.
+func parseIgnoreRules(patterns []string) ([]ignoreRule, error) {
+	var rules []ignoreRule
+	for _, pattern := range patterns {
+		rule, ok, err := parseIgnorePattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("parseIgnoreRules: %w", err)
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// ignoreMatcher decides whether paths in the backup sources are excluded,
+// using the configured exclude globs and all ignore files found in the
+// directories containing a path.
+type ignoreMatcher struct {
+	root  string
+	rules map[string][]ignoreRule
+}
+
+func newIgnoreMatcher(root string, excludeGlobs []string) (*ignoreMatcher, error) {
+	rules, err := parseIgnoreRules(excludeGlobs)
+	if err != nil {
+		return nil, fmt.Errorf("newIgnoreMatcher: error parsing exclude globs: %w", err)
+	}
+	return &ignoreMatcher{
+		root:  root,
+		rules: map[string][]ignoreRule{root: rules},
+	}, nil
+}
+
+// load reads the ignore file in the given directory in case it exists. Its
+// rules take precedence over rules defined in parent directories.
+func (m *ignoreMatcher) load(dir string) error {
+	f, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("load: error opening ignore file: %w", err)
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("load: error reading ignore file in %s: %w", dir, err)
+	}
+	rules, err := parseIgnoreRules(patterns)
+	if err != nil {
+		return fmt.Errorf("load: error parsing ignore file in %s: %w", dir, err)
+	}
+	m.rules[dir] = append(m.rules[dir], rules...)
+	return nil
+}
+
+// ignored returns whether the given path is excluded. Rules are evaluated
+// starting at the root, and the last matching rule decides.
+func (m *ignoreMatcher) ignored(location string, isDir bool) bool {
+	var dirs []string
+	for dir := filepath.Dir(location); ; dir = filepath.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+		if dir == m.root || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	var ignored bool
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(dir, location)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		for _, rule := range m.rules[dir] {
+			if rule.matches(rel, isDir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// filterIncluded returns the given paths below root that match at least one
+// of the given include rules. Paths below a matching directory are included
+// as well, and directories containing included paths are kept so the
+// archive preserves their metadata. The root itself is always kept.
+func filterIncluded(root string, paths []string, rules []ignoreRule) []string {
+	keep := map[string]bool{root: true}
+	for _, location := range paths {
+		rel, err := filepath.Rel(root, location)
+		if err != nil || rel == "." {
+			continue
+		}
+		fi, err := os.Lstat(location)
+		if err != nil {
+			continue
+		}
+		if !matchesIncluded(filepath.ToSlash(rel), fi.IsDir(), rules) {
+			continue
+		}
+		for dir := location; !keep[dir]; dir = filepath.Dir(dir) {
+			keep[dir] = true
+		}
+	}
+
+	var result []string
+	for _, location := range paths {
+		if keep[location] {
+			result = append(result, location)
+		}
+	}
+	return result
+}
+
+// matchesIncluded returns whether the given path or one of its parent
+// directories matches the given rules, with the last matching rule deciding.
+func matchesIncluded(rel string, isDir bool, rules []ignoreRule) bool {
+	segments := strings.Split(rel, "/")
+	var included bool
+	for i := range segments {
+		prefix := strings.Join(segments[:i+1], "/")
+		dir := isDir || i < len(segments)-1
+		for _, rule := range rules {
+			if rule.matches(prefix, dir) {
+				included = !rule.negate
+			}
+		}
+	}
+	return included
+}
@@ -0,0 +1,333 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"archive/tar"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// manifestName is the name of the file holding the manifest in the root
+// directory of archives created in incremental mode. It is never extracted
+// when restoring.
+const manifestName = ".docker-volume-backup-manifest.json"
+
+// manifest describes the state of all files in the backup sources at the
+// time a backup has been taken.
+type manifest struct {
+	Sources    string                   `json:"sources"`
+	FullBackup time.Time                `json:"fullBackup"`
+	Files      map[string]manifestEntry `json:"files"`
+	// Chain is the ID of the chain the backup belongs to and Sequence is its
+	// position in the chain. Both are part of the name of the backup, so
+	// chains can be told apart without downloading any backup.
+	Chain    string `json:"chain"`
+	Sequence int    `json:"sequence"`
+	// Deleted lists all files that have been deleted since the previous
+	// backup. It is only populated for incremental backups.
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+type manifestEntry struct {
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"modTime"`
+	Mode    fs.FileMode `json:"mode"`
+	Hash    string      `json:"hash,omitempty"`
+}
+
+// unchanged returns whether the entry describes the same file contents and
+// metadata as the given one, without looking at the hash.
+func (e manifestEntry) unchanged(other manifestEntry) bool {
+	return e.Size == other.Size && e.ModTime.Equal(other.ModTime) && e.Mode == other.Mode
+}
+
+// selectIncremental decides whether the current run creates a full or an
+// incremental backup in case BACKUP_INCREMENTAL is set. For incremental
+// backups, only directories and files that are new or have changed since the
+// previous backup are returned. The backup file is renamed to carry the
+// marker of its chain in both cases. A full backup is created in case no
+// manifest of a previous backup exists or the last full backup is older than
+// BACKUP_FULL_INTERVAL_DAYS.
+func (s *script) selectIncremental(backupSources string, files []string) ([]string, error) {
+	if !s.c.BackupIncremental {
+		return files, nil
+	}
+
+	previous, err := readManifest(s.c.BackupManifestFile)
+	if err != nil {
+		return nil, fmt.Errorf("selectIncremental: error reading previous manifest: %w", err)
+	}
+
+	if previous == nil {
+		s.logger.Infof(
+			"No manifest found at `%s`, taking a full backup. Make sure its directory is persisted across container restarts.",
+			s.c.BackupManifestFile,
+		)
+	}
+
+	// Manifests written by earlier versions do not carry a chain ID, so
+	// backups cannot be added to their chain.
+	full := previous == nil ||
+		previous.Chain == "" ||
+		previous.Sources != s.c.BackupSources ||
+		s.stats.StartTime.Sub(previous.FullBackup) >= time.Duration(s.c.BackupFullIntervalDays)*24*time.Hour
+
+	current := &manifest{
+		Sources:    s.c.BackupSources,
+		FullBackup: s.stats.StartTime,
+		Files:      map[string]manifestEntry{},
+	}
+	if full {
+		if current.Chain, err = newChainID(); err != nil {
+			return nil, fmt.Errorf("selectIncremental: %w", err)
+		}
+	} else {
+		current.FullBackup = previous.FullBackup
+		current.Chain = previous.Chain
+		current.Sequence = previous.Sequence + 1
+	}
+	s.file = withChainMarker(s.file, current.Chain, current.Sequence)
+
+	var selected []string
+	for _, file := range files {
+		rel, err := filepath.Rel(backupSources, file)
+		if err != nil {
+			return nil, fmt.Errorf("selectIncremental: error getting relative path of %s: %w", file, err)
+		}
+		fi, err := os.Lstat(file)
+		if err != nil {
+			return nil, fmt.Errorf("selectIncremental: error getting file info for %s: %w", file, err)
+		}
+		entry := manifestEntry{Size: fi.Size(), ModTime: fi.ModTime(), Mode: fi.Mode()}
+
+		// Directories are always included so that the structure of the
+		// sources and the metadata of directories can be restored.
+		if fi.IsDir() {
+			current.Files[rel] = entry
+			selected = append(selected, file)
+			continue
+		}
+
+		if !full {
+			if prev, ok := previous.Files[rel]; ok && prev.unchanged(entry) {
+				entry.Hash = prev.Hash
+				current.Files[rel] = entry
+				continue
+			}
+		}
+
+		if fi.Mode().IsRegular() {
+			if entry.Hash, err = hashFile(file); err != nil {
+				return nil, fmt.Errorf("selectIncremental: %w", err)
+			}
+		}
+		current.Files[rel] = entry
+		selected = append(selected, file)
+	}
+
+	s.manifest = current
+	if full {
+		s.logger.Infof("Creating full backup of %d file(s), writing manifest for subsequent incremental backups.", len(files))
+		return files, nil
+	}
+
+	for rel := range previous.Files {
+		if _, ok := current.Files[rel]; !ok {
+			current.Deleted = append(current.Deleted, rel)
+		}
+	}
+	sort.Strings(current.Deleted)
+
+	s.logger.Infof(
+		"Creating incremental backup containing %d new or changed and %d deleted file(s).",
+		len(selected), len(current.Deleted),
+	)
+	return selected, nil
+}
+
+// saveManifest persists the manifest of the current backup, so the next run
+// can create an incremental backup based on it. It is only called after the
+// backup has been stored successfully.
+func (s *script) saveManifest() error {
+	if s.manifest == nil {
+		return nil
+	}
+
+	// The list of deleted files only applies to the current backup.
+	m := *s.manifest
+	m.Deleted = nil
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("saveManifest: error encoding manifest: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.c.BackupManifestFile), 0755); err != nil {
+		return fmt.Errorf("saveManifest: error creating directory: %w", err)
+	}
+	// Writing to a temporary file first ensures a failed write does not leave
+	// behind a truncated manifest.
+	tmp := s.c.BackupManifestFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("saveManifest: error writing manifest: %w", err)
+	}
+	if err := os.Rename(tmp, s.c.BackupManifestFile); err != nil {
+		return fmt.Errorf("saveManifest: error moving manifest into place: %w", err)
+	}
+	return nil
+}
+
+// readManifest reads the manifest stored at the given location. In case no
+// such file exists, nil is returned.
+func readManifest(location string) (*manifest, error) {
+	data, err := os.ReadFile(location)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("readManifest: error reading file: %w", err)
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("readManifest: error decoding manifest: %w", err)
+	}
+	return m, nil
+}
+
+// writeManifest adds the given manifest to the archive written by tarWriter,
+// placing it in the given root directory.
+func writeManifest(m *manifest, aw *archiveWriter, root string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("writeManifest: error encoding manifest: %w", err)
+	}
+	if err := aw.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(root, manifestName),
+		Size:     int64(len(data)),
+		Mode:     0600,
+		ModTime:  aw.generatedModTime(),
+	}); err != nil {
+		return fmt.Errorf("writeManifest: error writing header: %w", err)
+	}
+	if _, err := aw.tw.Write(data); err != nil {
+		return fmt.Errorf("writeManifest: error writing manifest: %w", err)
+	}
+	return nil
+}
+
+// readManifestEntry decodes the manifest contained in an archive.
+func readManifestEntry(r io.Reader) (*manifest, error) {
+	m := &manifest{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, fmt.Errorf("readManifestEntry: error decoding manifest: %w", err)
+	}
+	return m, nil
+}
+
+// applyDeletions removes all files that are listed as deleted in the given
+// manifest from the given location.
+func applyDeletions(m *manifest, location string) error {
+	if m == nil {
+		return nil
+	}
+	for _, rel := range m.Deleted {
+		// Cleaning the path as an absolute one ensures deletions cannot
+		// escape the given location.
+		target := filepath.Join(location, filepath.Clean("/"+rel))
+		if err := checkSymlinks(location, filepath.Dir(target)); err != nil {
+			return fmt.Errorf("applyDeletions: refusing to remove %s: %w", rel, err)
+		}
+		if err := remove(target); err != nil {
+			return fmt.Errorf("applyDeletions: %w", err)
+		}
+	}
+	return nil
+}
+
+func hashFile(location string) (string, error) {
+	f, err := os.Open(location)
+	if err != nil {
+		return "", fmt.Errorf("hashFile: error opening %s: %w", location, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("hashFile: error reading %s: %w", location, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newChainID returns a random ID for a new chain of backups.
+func newChainID() (string, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("newChainID: error generating ID: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// withChainMarker inserts the marker for the given chain and sequence into
+// the given filename, keeping any known archive extension at its end.
+func withChainMarker(filename, id string, sequence int) string {
+	marker := storage.ChainMarker(id, sequence)
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(filename, ext) {
+			return strings.TrimSuffix(filename, ext) + marker + ext
+		}
+	}
+	return filename + marker
+}
+
+// resolveChain returns all backups that need to be restored in order to
+// restore the given backup, starting with the full backup it depends on.
+// Chains are looked up among all backups matching BACKUP_PRUNING_PREFIX.
+func (s *script) resolveChain(backend storage.Backend, backup storage.Backup) ([]storage.Backup, error) {
+	if !storage.IsIncremental(backup.Name) {
+		return []storage.Backup{backup}, nil
+	}
+
+	backups, err := backend.List(s.c.BackupPruningPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("resolveChain: error listing backups in storage %s: %w", backend.Name(), err)
+	}
+	for _, chain := range storage.Chains(storage.Group(backups)) {
+		for i, member := range chain {
+			if member.Name != backup.Name {
+				continue
+			}
+			if storage.IsIncremental(chain[0].Name) {
+				return nil, fmt.Errorf(
+					"resolveChain: unable to find the full backup incremental backup `%s` depends on in storage %s",
+					backup.Name, backend.Name(),
+				)
+			}
+			for sequence, member := range chain[:i+1] {
+				if _, n, _ := storage.ParseChainMarker(member.Name); n != sequence {
+					return nil, fmt.Errorf(
+						"resolveChain: unable to find all backups incremental backup `%s` depends on in storage %s",
+						backup.Name, backend.Name(),
+					)
+				}
+			}
+			return chain[:i+1], nil
+		}
+	}
+	return nil, fmt.Errorf("resolveChain: backup `%s` is not matching BACKUP_PRUNING_PREFIX", backup.Name)
+}
@@ -0,0 +1,170 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// listEntry describes a single backup as printed by the list command.
+type listEntry struct {
+	Storage      string            `json:"storage"`
+	Name         string            `json:"name"`
+	Size         int64             `json:"size"`
+	LastModified time.Time         `json:"lastModified"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	Parts        []string          `json:"parts,omitempty"`
+	Incremental  bool              `json:"incremental,omitempty"`
+	Prune        bool              `json:"prune"`
+}
+
+// list prints all backups found in all configured storage backends to the
+// given writer, flagging the ones that would be deleted when pruning using
+// the current configuration.
+func (s *script) list(args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print backups as JSON")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("list: error parsing arguments: %w", err)
+	}
+
+	prefixes := []string{s.c.BackupPruningPrefix}
+	if s.perSource() {
+		if err := s.resolveSources(); err != nil {
+			return fmt.Errorf("list: %w", err)
+		}
+		prefixes = nil
+		for _, src := range s.sources {
+			prefixes = append(prefixes, s.sourcePrefix(src))
+		}
+	}
+
+	deadline := s.pruningDeadline()
+	entries := []listEntry{}
+	for _, backend := range s.storages {
+		backups, err := backend.List("")
+		if err != nil {
+			return fmt.Errorf("list: error listing backups in storage %s: %w", backend.Name(), err)
+		}
+
+		// Pruning considers all files matching the pruning prefix, so the
+		// PRUNE column is computed before files that are not backups are
+		// left out. Pruning refuses to delete all existing files, which is
+		// why none of them would be pruned in such a case. When archiving
+		// each source on its own, this applies to the files of each source.
+		prunable := map[string]bool{}
+		if s.c.BackupRetentionDays >= 0 {
+			grouped := storage.Group(backups)
+			for _, prefix := range prefixes {
+				var candidates []storage.Backup
+				for _, backup := range grouped {
+					if strings.HasPrefix(backup.Name, prefix) {
+						candidates = append(candidates, backup)
+					}
+				}
+				matches := storage.Prunable(candidates, deadline)
+				if len(matches) == len(candidates) {
+					continue
+				}
+				for _, backup := range matches {
+					prunable[backup.Name] = true
+				}
+			}
+		}
+
+		var storageEntries []listEntry
+		for _, backup := range storage.Select(backups, isBackup) {
+			storageEntries = append(storageEntries, listEntry{
+				Storage:      backend.Name(),
+				Name:         backup.Name,
+				Size:         backup.Size,
+				LastModified: backup.LastModified,
+				Metadata:     backup.Metadata,
+				Parts:        backup.Parts,
+				Incremental:  storage.IsIncremental(backup.Name),
+				Prune:        prunable[backup.Name],
+			})
+		}
+
+		sort.Slice(storageEntries, func(i, j int) bool {
+			return storageEntries[i].LastModified.Before(storageEntries[j].LastModified)
+		})
+		entries = append(entries, storageEntries...)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(entries); err != nil {
+			return fmt.Errorf("list: error encoding backups: %w", err)
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STORAGE\tNAME\tSIZE\tAGE\tPRUNE")
+	for _, entry := range entries {
+		prune := "no"
+		if entry.Prune {
+			prune = "yes"
+		}
+		name := entry.Name
+		if len(entry.Parts) != 0 {
+			name = fmt.Sprintf("%s (%d parts)", name, len(entry.Parts))
+		}
+		fmt.Fprintf(
+			tw, "%s\t%s\t%s\t%s\t%s\n",
+			entry.Storage,
+			name,
+			formatBytes(uint64(entry.Size), false),
+			formatAge(time.Since(entry.LastModified)),
+			prune,
+		)
+	}
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("list: error writing table: %w", err)
+	}
+	return nil
+}
+
+// isBackup returns whether the file of the given name is a backup, i.e. an
+// archive that is optionally encrypted or the snapshot of a repository.
+// Parts and sidecars are expected to have been grouped with their backup.
+func isBackup(name string) bool {
+	name = trimEncryptionExtension(name)
+	if isSnapshot(name) {
+		return true
+	}
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatAge converts a duration into a short human-readable representation
+// using days, hours and minutes.
+func formatAge(d time.Duration) string {
+	days := int(d.Hours()) / 24
+	hours := int(d.Hours()) % 24
+	minutes := int(d.Minutes()) % 60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd%dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh%dm", hours, minutes)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
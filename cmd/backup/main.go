@@ -4,14 +4,31 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
 )
 
 func main() {
+	flag.Parse()
+
 	s, err := newScript()
 	if err != nil {
 		panic(err)
 	}
+	s.command = flag.Arg(0)
+
+	if flag.Arg(0) == "list" {
+		// Listing backups is read-only, so it neither waits for the lock nor
+		// runs any hooks. Log output is written to stderr so it does not get
+		// mixed up with the list itself.
+		s.logger.Out = &redactingWriter{writer: os.Stderr, redactor: s.redactor}
+		if err := s.list(flag.Args()[1:], os.Stdout); err != nil {
+			s.logger.Errorf("Fatal error listing backups: %s", err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	unlock, err := s.lock("/var/lock/dockervolumebackup.lock")
 	defer unlock()
@@ -38,6 +55,27 @@ func main() {
 		s.logger.Info("Finished running backup tasks.")
 	}()
 
+	switch command := flag.Arg(0); command {
+	case "", "backup":
+		runBackup(s)
+	case "restore":
+		s.must(s.restore(flag.Arg(1)))
+	case "verify":
+		s.must(s.verify(flag.Arg(1)))
+	default:
+		s.must(fmt.Errorf("main: unknown command `%s`", command))
+	}
+}
+
+// runBackup runs all phases of a backup, i.e. creating the archive,
+// processing it, copying it to all storages and pruning old backups.
+func runBackup(s *script) {
+	s.must(s.resolveSources())
+	// Checking for free space happens before any labeled commands are run or
+	// containers are stopped, so a failing check does not cause downtime.
+	s.must(s.checkStagingSpace())
+	s.must(s.resolveCapturedOutputs())
+
 	s.must(s.withLabeledCommands(lifecyclePhaseArchive, func() error {
 		restartContainers, err := s.stopContainers()
 		// The mechanism for restarting containers is not using hooks as it
@@ -49,10 +87,40 @@ func main() {
 		if err != nil {
 			return err
 		}
-		return s.createArchive()
+		if s.c.BackupStream {
+			// When streaming, archiving, processing and copying happen at the
+			// same time, so all labeled commands are run around the pipeline.
+			return s.withLabeledCommands(
+				lifecyclePhaseProcess,
+				s.withLabeledCommands(lifecyclePhaseCopy, s.forEachSource(s.streamArchive)),
+			)()
+		}
+		return s.forEachSource(s.createArchive)()
 	})())
 
-	s.must(s.withLabeledCommands(lifecyclePhaseProcess, s.encryptArchive)())
-	s.must(s.withLabeledCommands(lifecyclePhaseCopy, s.copyArchive)())
-	s.must(s.withLabeledCommands(lifecyclePhasePrune, s.pruneBackups)())
+	if s.c.BackupFormat == formatRepository {
+		// Chunks are encrypted individually when being copied, so processing
+		// is limited to verifying the archive.
+		s.must(s.withLabeledCommands(lifecyclePhaseProcess, s.verifyArchive)())
+		s.must(s.withLabeledCommands(lifecyclePhaseCopy, s.copyRepository)())
+		s.must(s.withLabeledCommands(lifecyclePhasePrune, s.pruneRepository)())
+		return
+	}
+
+	if !s.c.BackupStream {
+		s.must(s.withLabeledCommands(lifecyclePhaseProcess, s.forEachSource(func() error {
+			if err := s.encryptArchive(); err != nil {
+				return err
+			}
+			if err := s.verifyArchive(); err != nil {
+				return err
+			}
+			if err := s.signArchive(); err != nil {
+				return err
+			}
+			return s.splitArchive()
+		}))())
+		s.must(s.withLabeledCommands(lifecyclePhaseCopy, s.forEachSource(s.copyArchive))())
+	}
+	s.must(s.withLabeledCommands(lifecyclePhasePrune, s.forEachSource(s.pruneBackups))())
 }
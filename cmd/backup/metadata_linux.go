@@ -0,0 +1,126 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns all extended attributes of the file at the given
+// location without following symlinks. POSIX ACLs are stored in the
+// `system.posix_acl_access` and `system.posix_acl_default` attributes,
+// so they are included as well.
+func readXattrs(location string) (map[string]string, error) {
+	size, err := unix.Llistxattr(location, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("readXattrs: error listing attributes of %s: %w", location, err)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(location, buf); err != nil {
+		return nil, fmt.Errorf("readXattrs: error listing attributes of %s: %w", location, err)
+	}
+
+	xattrs := map[string]string{}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		valueSize, err := unix.Lgetxattr(location, name, nil)
+		if err != nil {
+			// The attribute might have been removed in the meantime.
+			if errors.Is(err, unix.ENODATA) {
+				continue
+			}
+			return nil, fmt.Errorf("readXattrs: error reading attribute %s of %s: %w", name, location, err)
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Lgetxattr(location, name, value); err != nil {
+			return nil, fmt.Errorf("readXattrs: error reading attribute %s of %s: %w", name, location, err)
+		}
+		xattrs[name] = string(value[:valueSize])
+	}
+	return xattrs, nil
+}
+
+// applyXattrs sets the given extended attributes on the file at the given
+// location without following symlinks. Attributes that are not supported by
+// the file system or that require further privileges (e.g. `security.*` and
+// `trusted.*` attributes) are skipped and returned along with the error
+// that occurred when setting them.
+func applyXattrs(location string, xattrs map[string]string) (map[string]error, error) {
+	var skipped map[string]error
+	for name, value := range xattrs {
+		if err := unix.Lsetxattr(location, name, []byte(value), 0); err != nil {
+			if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+				if skipped == nil {
+					skipped = map[string]error{}
+				}
+				skipped[name] = err
+				continue
+			}
+			return skipped, fmt.Errorf("applyXattrs: error setting attribute %s on %s: %w", name, location, err)
+		}
+	}
+	return skipped, nil
+}
+
+// dataRegions returns the regions of the given file that contain data in
+// case the file is sparse, i.e. it allocates less space than its size. For
+// files that are not sparse, nil is returned.
+func dataRegions(f *os.File, fileInfo os.FileInfo) ([]sparseRegion, error) {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok || stat.Blocks*512 >= fileInfo.Size() {
+		return nil, nil
+	}
+
+	var regions []sparseRegion
+	fd := int(f.Fd())
+	size := fileInfo.Size()
+	for offset := int64(0); offset < size; {
+		start, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err != nil {
+			// ENXIO signals there is no more data after the given offset.
+			if errors.Is(err, unix.ENXIO) {
+				break
+			}
+			// Filesystems that do not support seeking holes and data are
+			// handled like files that are not sparse.
+			if errors.Is(err, unix.EINVAL) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("dataRegions: error seeking data: %w", err)
+		}
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, fmt.Errorf("dataRegions: error seeking hole: %w", err)
+		}
+		if end > size {
+			end = size
+		}
+		regions = append(regions, sparseRegion{offset: start, length: end - start})
+		offset = end
+	}
+
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return nil, fmt.Errorf("dataRegions: error resetting offset: %w", err)
+	}
+	if len(regions) == 1 && regions[0].offset == 0 && regions[0].length == size {
+		return nil, nil
+	}
+	return regions, nil
+}
@@ -0,0 +1,26 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !linux
+
+package main
+
+import (
+	"os"
+)
+
+// readXattrs is not supported on this platform and returns no attributes.
+func readXattrs(location string) (map[string]string, error) {
+	return nil, nil
+}
+
+// applyXattrs is not supported on this platform and does nothing.
+func applyXattrs(location string, xattrs map[string]string) (map[string]error, error) {
+	return nil, nil
+}
+
+// dataRegions is not supported on this platform, so all files are handled
+// as if they were not sparse.
+func dataRegions(f *os.File, fileInfo os.FileInfo) ([]sparseRegion, error) {
+	return nil, nil
+}
@@ -18,7 +18,8 @@ import (
 //go:embed notifications.tmpl
 var defaultNotifications string
 
-// NotificationData data to be passed to the notification templates
+// NotificationData data to be passed to the notification templates. Sensitive
+// values are redacted from all of its fields.
 type NotificationData struct {
 	Error  error
 	Config *Config
@@ -29,9 +30,9 @@ type NotificationData struct {
 // Automatically creates notification data, adding the given error
 func (s *script) notify(titleTemplate string, bodyTemplate string, err error) error {
 	params := NotificationData{
-		Error:  err,
+		Error:  s.redactedError(err),
 		Stats:  s.stats,
-		Config: s.c,
+		Config: redactedConfig(s.c),
 	}
 
 	titleBuf := &bytes.Buffer{}
@@ -50,14 +51,25 @@ func (s *script) notify(titleTemplate string, bodyTemplate string, err error) er
 	return nil
 }
 
-// notifyFailure sends a notification about a failed backup run
+// notifyFailure sends a notification about a failed run
 func (s *script) notifyFailure(err error) error {
-	return s.notify("title_failure", "body_failure", err)
+	return s.notify(s.templateName("title", "failure"), s.templateName("body", "failure"), err)
 }
 
-// notifyFailure sends a notification about a successful backup run
+// notifyFailure sends a notification about a successful run
 func (s *script) notifySuccess() error {
-	return s.notify("title_success", "body_success", nil)
+	return s.notify(s.templateName("title", "success"), s.templateName("body", "success"), nil)
+}
+
+// templateName returns the name of the template used for the given part and
+// outcome of the current command. Commands other than `backup` use their own
+// templates, e.g. `title_restore_failure`, so a restore is never reported as
+// a backup.
+func (s *script) templateName(part, outcome string) string {
+	if s.command == "" || s.command == "backup" {
+		return part + "_" + outcome
+	}
+	return part + "_" + s.command + "_" + outcome
 }
 
 // sendNotification sends a notification to all configured third party services
@@ -84,7 +96,21 @@ var templateHelpers = template.FuncMap{
 	"formatBytesBin": func(bytes uint64) string {
 		return formatBytes(bytes, false)
 	},
-	"env": os.Getenv,
+}
+
+// templateHelpers returns the helper functions that depend on the
+// configuration of the script.
+func (s *script) templateHelpers() template.FuncMap {
+	return template.FuncMap{
+		"env": func(key string) string {
+			return s.redactor.Replace(os.Getenv(key))
+		},
+		// rawConfig allows templates to explicitly opt into using the values
+		// of sensitive configuration fields.
+		"rawConfig": func() *Config {
+			return s.c
+		},
+	}
 }
 
 // formatBytes converts an amount of bytes in a human-readable representation
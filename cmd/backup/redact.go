@@ -0,0 +1,130 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// redactedValue replaces sensitive values in notifications and log output.
+const redactedValue = "[REDACTED]"
+
+// sensitiveFields calls fn for each field of the given configuration that is
+// tagged as sensitive.
+func sensitiveFields(c *Config, fn func(field reflect.Value)) {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("sensitive") == "true" {
+			fn(v.Field(i))
+		}
+	}
+}
+
+// sensitiveValues returns the non-empty values of sensitive configuration
+// fields, longest first. Short values also replace parts of unrelated output,
+// which is accepted as leaking them would be worse.
+func sensitiveValues(c *Config) []string {
+	var values []string
+	sensitiveFields(c, func(field reflect.Value) {
+		switch field.Kind() {
+		case reflect.String:
+			values = append(values, field.String())
+		case reflect.Slice:
+			values = append(values, field.Interface().([]string)...)
+		}
+	})
+
+	var result []string
+	for _, value := range values {
+		if value != "" {
+			result = append(result, value)
+		}
+	}
+	// Longer values are replaced first, so values that contain other values
+	// are fully redacted.
+	sort.SliceStable(result, func(i, j int) bool {
+		return len(result[i]) > len(result[j])
+	})
+	return result
+}
+
+// newRedactor returns a replacer that replaces all sensitive values of the
+// given configuration.
+func newRedactor(c *Config) *strings.Replacer {
+	var pairs []string
+	for _, value := range sensitiveValues(c) {
+		pairs = append(pairs, value, redactedValue)
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// redactedConfig returns a copy of the given configuration with the values of
+// all sensitive fields replaced.
+func redactedConfig(c *Config) *Config {
+	redacted := *c
+	sensitiveFields(&redacted, func(field reflect.Value) {
+		switch field.Kind() {
+		case reflect.String:
+			if field.String() != "" {
+				field.SetString(redactedValue)
+			}
+		case reflect.Slice:
+			values := make([]string, field.Len())
+			for i := range values {
+				values[i] = redactedValue
+			}
+			field.Set(reflect.ValueOf(values))
+		}
+	})
+	return &redacted
+}
+
+// redactedError returns an error with the same message as the given one,
+// with all sensitive values replaced. The given error is still returned when
+// unwrapping the result, so errors.Is and errors.As keep working.
+func (s *script) redactedError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &redactingError{err: err, message: s.redactor.Replace(err.Error())}
+}
+
+// redactingError wraps an error, replacing its message.
+type redactingError struct {
+	err     error
+	message string
+}
+
+func (e *redactingError) Error() string {
+	return e.message
+}
+
+func (e *redactingError) Unwrap() error {
+	return e.err
+}
+
+// redactingWriter replaces all sensitive values in the data written to it
+// before passing it on to the wrapped writer.
+type redactingWriter struct {
+	writer   io.Writer
+	redactor *strings.Replacer
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := r.writer.Write([]byte(r.redactor.Replace(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// forwardOutput writes the given output of a command to stderr and stdout,
+// with all sensitive values replaced.
+func (s *script) forwardOutput(stdout, stderr []byte) {
+	(&redactingWriter{writer: os.Stderr, redactor: s.redactor}).Write(stderr)
+	(&redactingWriter{writer: os.Stdout, redactor: s.redactor}).Write(stdout)
+}
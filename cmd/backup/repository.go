@@ -0,0 +1,549 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// Format is the format backups are stored in.
+type Format string
+
+const (
+	formatArchive    Format = "archive"
+	formatRepository Format = "repository"
+)
+
+func (f *Format) Decode(v string) error {
+	switch v {
+	case "archive":
+		*f = formatArchive
+	case "repository":
+		*f = formatRepository
+	default:
+		return fmt.Errorf("config: unknown backup format `%s`, expected one of archive or repository", v)
+	}
+	return nil
+}
+
+const (
+	// Chunks are stored in a directory of their own, so they are never
+	// mistaken for backups when listing or pruning backups.
+	chunkPrefix       = "chunks/chunk-"
+	snapshotExtension = ".snapshot"
+)
+
+// snapshot is the index of a backup stored in repository format. Joining
+// the contents of all chunks in order yields an uncompressed tar archive of
+// the backup sources.
+type snapshot struct {
+	Time    time.Time `json:"time"`
+	Sources string    `json:"sources"`
+	Size    int64     `json:"size"`
+	Chunks  []string  `json:"chunks"`
+	// Recipients identifies the public keys the chunks have been encrypted
+	// to, which is needed for checking their names when restoring.
+	Recipients string `json:"recipients,omitempty"`
+}
+
+// isSnapshot returns whether the object of the given name is the index of
+// a snapshot in a repository.
+func isSnapshot(name string) bool {
+	return strings.HasSuffix(trimEncryptionExtension(name), snapshotExtension)
+}
+
+// archiveCompression returns the compression used for the archive that is
+// created in the staging directory. In repository mode, chunks are
+// compressed individually, so the archive itself is left uncompressed.
+func (s *script) archiveCompression() Compression {
+	if s.c.BackupFormat == formatRepository {
+		return compressionNone
+	}
+	return s.c.BackupCompression
+}
+
+// snapshotName returns the name of the index of the current snapshot, which
+// is derived from BACKUP_FILENAME.
+func (s *script) snapshotName() string {
+	_, name := path.Split(s.file)
+	name = strings.TrimSuffix(name, compressionNone.extension()) + snapshotExtension
+	return name + s.encryptionExtension()
+}
+
+// chunkKey returns the key the names of chunks are derived from. In case a
+// passphrase is configured, it is used so the names of chunks do not reveal
+// whether a repository contains some known data. When using public keys, the
+// keys are identified instead, so chunks are stored anew once the keys change
+// and can be read using the new identities. Without encryption, chunks are
+// named after their plain hash.
+func (s *script) chunkKey() string {
+	if passphrase := s.encryptionPassphrase(); passphrase != "" {
+		return passphrase
+	}
+	return s.recipientsID()
+}
+
+// chunkName returns the name a chunk holding the given data is stored under
+// when deriving names using the given key.
+func (s *script) chunkName(data []byte, key string) string {
+	if key == "" {
+		sum := sha256.Sum256(data)
+		return chunkPrefix + hex.EncodeToString(sum[:]) + s.encryptionExtension()
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return chunkPrefix + hex.EncodeToString(mac.Sum(nil)) + s.encryptionExtension()
+}
+
+// recipientsID returns an identifier for the set of configured public keys,
+// or an empty string in case no public keys are configured.
+func (s *script) recipientsID() string {
+	var keys []string
+	for _, key := range s.publicKeys {
+		keys = append(keys, hex.EncodeToString(key.PrimaryKey.Fingerprint))
+	}
+	keys = append(keys, s.ageRecipientKeys...)
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+	sum := sha256.Sum256([]byte(strings.Join(keys, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeObject compresses the given data using the configured compression
+// and encrypts it in case a passphrase or public keys are configured.
+func (s *script) encodeObject(data []byte, name string) ([]byte, error) {
+	var buf bytes.Buffer
+	dst := io.WriteCloser(nopWriteCloser{&buf})
+	if s.encrypts() {
+		var err error
+		if dst, err = s.newEncryptionWriter(&buf, name); err != nil {
+			return nil, fmt.Errorf("encodeObject: error creating encryption writer: %w", err)
+		}
+	}
+	w, err := newCompressionWriter(dst, s.c.BackupCompression, s.c.BackupCompressionLevel, 1)
+	if err != nil {
+		return nil, fmt.Errorf("encodeObject: error creating compression writer: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("encodeObject: error writing data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("encodeObject: error closing compression writer: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		return nil, fmt.Errorf("encodeObject: error closing encryption writer: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// readObject reads the object of the given name from the given backend,
+// decrypting and decompressing it.
+func (s *script) readObject(backend storage.Backend, name string) ([]byte, error) {
+	raw, err := downloadObject(backend, name)
+	if err != nil {
+		return nil, fmt.Errorf("readObject: %w", err)
+	}
+	data, err := s.decodeObject(raw, name)
+	if err != nil {
+		return nil, fmt.Errorf("readObject: %w", err)
+	}
+	return data, nil
+}
+
+// downloadObject returns the data of the object of the given name as it is
+// stored.
+func downloadObject(backend storage.Backend, name string) ([]byte, error) {
+	src, err := backend.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("downloadObject: error opening %s: %w", name, err)
+	}
+	defer src.Close()
+
+	raw, err := io.ReadAll(src)
+	if err != nil {
+		return nil, fmt.Errorf("downloadObject: error reading %s: %w", name, err)
+	}
+	return raw, nil
+}
+
+// decodeObject decrypts and decompresses the given data of the object of the
+// given name.
+func (s *script) decodeObject(raw []byte, name string) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(raw)
+	if isEncrypted(name) {
+		var err error
+		if r, err = s.decryptArchive(r, name); err != nil {
+			return nil, fmt.Errorf("decodeObject: error decrypting %s: %w", name, err)
+		}
+	}
+	decompressionReader, err := newDecompressionReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("decodeObject: error decompressing %s: %w", name, err)
+	}
+	defer decompressionReader.Close()
+
+	// Reading the decompressed data until EOF also reads the underlying
+	// data in full, which makes sure its integrity is checked on decryption.
+	data, err := io.ReadAll(decompressionReader)
+	if err != nil {
+		return nil, fmt.Errorf("decodeObject: error reading %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// putObject stores the given data under the given name in all given
+// backends.
+func putObject(backends []storage.Backend, name string, data []byte) error {
+	eg := errgroup.Group{}
+	for _, backend := range backends {
+		b := backend
+		eg.Go(func() error {
+			return b.Put(name, bytes.NewReader(data))
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return fmt.Errorf("putObject: error storing %s: %w", name, err)
+	}
+	return nil
+}
+
+// copyRepository splits the archive into chunks and stores all chunks that
+// do not exist yet in the configured storages. A snapshot index referencing
+// all chunks is stored after all chunks have been stored.
+func (s *script) copyRepository() error {
+	existing := map[string]map[string]bool{}
+	for _, backend := range s.storages {
+		chunks, err := backend.List(chunkPrefix)
+		if err != nil {
+			return fmt.Errorf("copyRepository: error listing chunks in storage %s: %w", backend.Name(), err)
+		}
+		existing[backend.Name()] = map[string]bool{}
+		for _, chunk := range chunks {
+			existing[backend.Name()][chunk.Name] = true
+		}
+	}
+
+	f, err := os.Open(s.file)
+	if err != nil {
+		return fmt.Errorf("copyRepository: error opening backup file: %w", err)
+	}
+	defer f.Close()
+
+	snap := snapshot{Time: s.stats.StartTime, Sources: s.c.BackupSources, Recipients: s.recipientsID()}
+	key := s.chunkKey()
+	var newChunks int
+	var uploaded uint64
+	c := newChunker(f)
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("copyRepository: error chunking backup file: %w", err)
+		}
+
+		name := s.chunkName(data, key)
+		snap.Chunks = append(snap.Chunks, name)
+		snap.Size += int64(len(data))
+
+		var missing []storage.Backend
+		for _, backend := range s.storages {
+			if !existing[backend.Name()][name] {
+				missing = append(missing, backend)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		encoded, err := s.encodeObject(data, name)
+		if err != nil {
+			return fmt.Errorf("copyRepository: error encoding chunk: %w", err)
+		}
+		if err := putObject(missing, name, encoded); err != nil {
+			return fmt.Errorf("copyRepository: %w", err)
+		}
+		for _, backend := range missing {
+			existing[backend.Name()][name] = true
+		}
+		newChunks++
+		uploaded += uint64(len(encoded))
+	}
+
+	index, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("copyRepository: error encoding snapshot: %w", err)
+	}
+	name := s.snapshotName()
+	encoded, err := s.encodeObject(index, name)
+	if err != nil {
+		return fmt.Errorf("copyRepository: error encoding snapshot: %w", err)
+	}
+	if err := putObject(s.storages, name, encoded); err != nil {
+		return fmt.Errorf("copyRepository: %w", err)
+	}
+	// Chunks are checked against their names when being read, so signing the
+	// snapshot index covers all of its chunks.
+	if s.signingKey != nil {
+		signature, err := s.sign(bytes.NewReader(encoded))
+		if err != nil {
+			return fmt.Errorf("copyRepository: error signing snapshot: %w", err)
+		}
+		if err := putObject(s.storages, name+storage.SignatureSuffix, signature); err != nil {
+			return fmt.Errorf("copyRepository: %w", err)
+		}
+	}
+
+	s.stats.BackupFile = BackupFileStats{
+		Size:     uint64(snap.Size),
+		Name:     name,
+		FullPath: name,
+	}
+	s.logger.Infof(
+		"Stored snapshot `%s` consisting of %d chunk(s), %d of them new with a total size of %s.",
+		name, len(snap.Chunks), newChunks, formatBytes(uploaded, false),
+	)
+	return nil
+}
+
+// readSnapshot reads the snapshot index of the given name.
+func (s *script) readSnapshot(backend storage.Backend, name string) (*snapshot, error) {
+	raw, err := downloadObject(backend, name)
+	if err != nil {
+		return nil, fmt.Errorf("readSnapshot: %w", err)
+	}
+	snap, err := s.decodeSnapshot(raw, name)
+	if err != nil {
+		return nil, fmt.Errorf("readSnapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// decodeSnapshot decodes the given data of the snapshot index of the given
+// name.
+func (s *script) decodeSnapshot(raw []byte, name string) (*snapshot, error) {
+	data, err := s.decodeObject(raw, name)
+	if err != nil {
+		return nil, fmt.Errorf("decodeSnapshot: %w", err)
+	}
+	snap := &snapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		return nil, fmt.Errorf("decodeSnapshot: error decoding snapshot %s: %w", name, err)
+	}
+	return snap, nil
+}
+
+// openSnapshot returns a reader yielding the uncompressed tar archive
+// stored in the given snapshot. Chunks are fetched while reading and their
+// integrity is checked against their names.
+func (s *script) openSnapshot(backend storage.Backend, backup storage.Backup) (io.ReadCloser, *snapshot, error) {
+	// The index is downloaded once, so that the data that is decoded is the
+	// data whose signature has been checked.
+	raw, err := downloadObject(backend, backup.Name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("openSnapshot: %w", err)
+	}
+	if err := s.checkSignature(backend, backup.Name, bytes.NewReader(raw)); err != nil {
+		return nil, nil, fmt.Errorf("openSnapshot: %w", err)
+	}
+
+	snap, err := s.decodeSnapshot(raw, backup.Name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("openSnapshot: %w", err)
+	}
+
+	// Restoring does not require the public keys chunks have been encrypted
+	// to, which is why the snapshot identifies them.
+	key := snap.Recipients
+	if key == "" {
+		key = s.encryptionPassphrase()
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		for _, name := range snap.Chunks {
+			data, err := s.readObject(backend, name)
+			if err != nil {
+				pw.CloseWithError(fmt.Errorf("openSnapshot: %w", err))
+				return
+			}
+			// The extension cannot be derived from the configuration either,
+			// so it is ignored.
+			if trimEncryptionExtension(s.chunkName(data, key)) != trimEncryptionExtension(name) {
+				pw.CloseWithError(fmt.Errorf("openSnapshot: chunk %s is corrupted", name))
+				return
+			}
+			if _, err := pw.Write(data); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return pr, snap, nil
+}
+
+// restoreSnapshot extracts the given snapshot into the configured backup
+// sources.
+func (s *script) restoreSnapshot(backend storage.Backend, backup storage.Backup) error {
+	r, snap, err := s.openSnapshot(backend, backup)
+	if err != nil {
+		return fmt.Errorf("restoreSnapshot: error opening snapshot: %w", err)
+	}
+	defer r.Close()
+
+	s.stats.BackupFile = BackupFileStats{
+		Size:     uint64(snap.Size),
+		Name:     backup.Name,
+		FullPath: backup.Name,
+	}
+
+	restartContainers, err := s.stopContainers()
+	defer func() {
+		s.must(restartContainers())
+	}()
+	if err != nil {
+		return err
+	}
+
+	if err := extractArchive(r, s.c.BackupSources, s.c.BackupPreserveMetadata, s.logger.Warnf); err != nil {
+		return fmt.Errorf("restoreSnapshot: error extracting snapshot: %w", err)
+	}
+	s.logger.Infof(
+		"Restored snapshot `%s` from storage %s into `%s`.",
+		backup.Name, backend.Name(), s.c.BackupSources,
+	)
+	return nil
+}
+
+// pruneRepository deletes snapshots that are older than the configured
+// retention period from all storages and deletes all chunks that are not
+// referenced by any snapshot anymore afterwards.
+func (s *script) pruneRepository() error {
+	if s.c.BackupRetentionDays < 0 {
+		return nil
+	}
+
+	deadline := s.pruningDeadline()
+	eg := errgroup.Group{}
+	for _, backend := range s.storages {
+		b := backend
+		eg.Go(func() error {
+			return s.pruneSnapshots(b, deadline)
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return fmt.Errorf("pruneRepository: error pruning repository: %w", err)
+	}
+	return nil
+}
+
+func (s *script) pruneSnapshots(backend storage.Backend, deadline time.Time) error {
+	backups, err := backend.List(s.c.BackupPruningPrefix)
+	if err != nil {
+		return fmt.Errorf("pruneSnapshots: error listing snapshots in storage %s: %w", backend.Name(), err)
+	}
+
+	var candidates, matches []storage.Backup
+	for _, backup := range storage.Group(backups) {
+		if !isSnapshot(backup.Name) {
+			continue
+		}
+		candidates = append(candidates, backup)
+		if backup.LastModified.Before(deadline) {
+			matches = append(matches, backup)
+		}
+	}
+
+	if len(matches) != 0 && len(matches) == len(candidates) {
+		s.logger.Warnf(
+			"[%s] The current configuration would delete all %d existing snapshot(s). Refusing to do so, please check your configuration.",
+			backend.Name(), len(matches),
+		)
+		matches = nil
+	}
+
+	for _, match := range matches {
+		for _, name := range append([]string{match.Name}, match.Sidecars...) {
+			if err := backend.Delete(name); err != nil {
+				return fmt.Errorf("pruneSnapshots: error deleting snapshot %s: %w", name, err)
+			}
+		}
+	}
+
+	s.stats.Lock()
+	storageStats := s.stats.Storages[backend.Name()]
+	storageStats.Total += uint(len(candidates))
+	storageStats.Pruned += uint(len(matches))
+	s.stats.Storages[backend.Name()] = storageStats
+	s.stats.Unlock()
+
+	if len(matches) == 0 {
+		s.logger.Infof("[%s] None of %d existing snapshot(s) were pruned.", backend.Name(), len(candidates))
+		return nil
+	}
+	s.logger.Infof("[%s] Pruned %d out of %d snapshot(s).", backend.Name(), len(matches), len(candidates))
+	return s.collectGarbage(backend)
+}
+
+// collectGarbage deletes all chunks in the given backend that are not
+// referenced by any snapshot. Snapshots of all prefixes are considered, as
+// they might share chunks. In case any snapshot cannot be read, no chunks
+// are deleted.
+func (s *script) collectGarbage(backend storage.Backend) error {
+	objects, err := backend.List("")
+	if err != nil {
+		return fmt.Errorf("collectGarbage: error listing objects in storage %s: %w", backend.Name(), err)
+	}
+	chunkObjects, err := backend.List(chunkPrefix)
+	if err != nil {
+		return fmt.Errorf("collectGarbage: error listing chunks in storage %s: %w", backend.Name(), err)
+	}
+
+	referenced := map[string]bool{}
+	for _, object := range objects {
+		if !isSnapshot(object.Name) {
+			continue
+		}
+		snap, err := s.readSnapshot(backend, object.Name)
+		if err != nil {
+			return fmt.Errorf("collectGarbage: error reading snapshot, not deleting any chunks: %w", err)
+		}
+		for _, chunk := range snap.Chunks {
+			referenced[chunk] = true
+		}
+	}
+	var chunks []string
+	for _, object := range chunkObjects {
+		chunks = append(chunks, object.Name)
+	}
+
+	var removed int
+	for _, chunk := range chunks {
+		if referenced[chunk] {
+			continue
+		}
+		if err := backend.Delete(chunk); err != nil {
+			return fmt.Errorf("collectGarbage: error deleting chunk %s: %w", chunk, err)
+		}
+		removed++
+	}
+	s.logger.Infof("[%s] Deleted %d out of %d chunk(s) that are not referenced anymore.", backend.Name(), removed, len(chunks))
+	return nil
+}
@@ -0,0 +1,245 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// restore downloads the backup of the given name from the configured storage
+// backends, decrypts it if needed and extracts it into the configured backup
+// sources. Passing `latest` restores the most recent backup. Incremental
+// backups are restored by replaying all backups back to the full backup they
+// depend on. Containers that are labeled to be stopped during backup are also
+// stopped while files are being replaced. In case BACKUP_PER_SOURCE is set,
+// the backup is restored into the source it has been created from. Dumps of
+// containers labeled with `docker-volume-backup.database` are loaded into
+// the respective database afterwards.
+func (s *script) restore(name string) error {
+	if name == "" {
+		return errors.New("restore: no backup given, pass the name of a backup or `latest`")
+	}
+	if s.perSource() && name == "latest" {
+		return errors.New("restore: `latest` cannot be used when BACKUP_PER_SOURCE is set, pass the name of a backup instead")
+	}
+
+	backend, backup, err := s.findBackup(name)
+	if err != nil {
+		return fmt.Errorf("restore: error looking up backup: %w", err)
+	}
+
+	// Database dumps are loaded once all files have been restored and all
+	// containers are running again.
+	if isSnapshot(backup.Name) {
+		if err := s.restoreSnapshot(backend, *backup); err != nil {
+			return err
+		}
+		return s.restoreDatabases()
+	}
+
+	if s.perSource() {
+		if err := s.resolveSources(); err != nil {
+			return fmt.Errorf("restore: %w", err)
+		}
+		src, err := s.sourceOf(backup.Name)
+		if err != nil {
+			return fmt.Errorf("restore: %w", err)
+		}
+		return s.withSource(src, func() error {
+			if err := s.restoreBackup(backend, *backup); err != nil {
+				return err
+			}
+			return s.restoreDatabases()
+		})
+	}
+	if err := s.restoreBackup(backend, *backup); err != nil {
+		return err
+	}
+	return s.restoreDatabases()
+}
+
+// restoreBackup restores the given backup into the configured backup
+// sources, replaying all backups it depends on.
+func (s *script) restoreBackup(backend storage.Backend, backup storage.Backup) error {
+	// Volumes are restored into the staging directory first and copied into
+	// the volume afterwards.
+	if s.volume != nil {
+		if err := s.prepareVolumeDirectory(); err != nil {
+			return fmt.Errorf("restoreBackup: %w", err)
+		}
+	}
+
+	chain, err := s.resolveChain(backend, backup)
+	if err != nil {
+		return fmt.Errorf("restoreBackup: error resolving backups to restore: %w", err)
+	}
+
+	var files []string
+	for _, member := range chain {
+		file := path.Join(s.c.BackupStagingDirectory, path.Base(member.Name))
+		s.registerHook(hookLevelPlumbing, func(error) error {
+			if err := remove(file); err != nil {
+				return fmt.Errorf("restoreBackup: error removing downloaded file: %w", err)
+			}
+			s.logger.Infof("Removed downloaded file `%s`.", file)
+			return nil
+		})
+
+		if err := download(backend, member, file); err != nil {
+			return fmt.Errorf("restoreBackup: error downloading backup: %w", err)
+		}
+		s.logger.Infof("Downloaded backup `%s` from storage %s to `%s`.", member.Name, backend.Name(), file)
+		if err := s.checkDownload(backend, member.Name, file); err != nil {
+			return fmt.Errorf("restoreBackup: %w", err)
+		}
+		files = append(files, file)
+	}
+
+	file := files[len(files)-1]
+	if stat, err := os.Stat(file); err != nil {
+		return fmt.Errorf("restoreBackup: unable to stat downloaded file: %w", err)
+	} else {
+		s.stats.BackupFile = BackupFileStats{
+			Size:     uint64(stat.Size()),
+			Name:     backup.Name,
+			FullPath: file,
+		}
+	}
+
+	restartContainers, err := s.stopContainers()
+	// As when taking a backup, containers are restarted as soon as all files
+	// have been restored.
+	defer func() {
+		s.must(restartContainers())
+	}()
+	if err != nil {
+		return err
+	}
+
+	for i, file := range files {
+		if err := s.extractFile(file); err != nil {
+			return fmt.Errorf("restoreBackup: error restoring backup `%s`: %w", chain[i].Name, err)
+		}
+	}
+	if s.volume != nil {
+		if err := s.importVolume(); err != nil {
+			return fmt.Errorf("restoreBackup: %w", err)
+		}
+	}
+
+	if len(chain) > 1 {
+		s.logger.Infof(
+			"Restored backup `%s` into `%s`, replaying %d incremental backup(s) on top of full backup `%s`.",
+			backup.Name, s.c.BackupSources, len(chain)-1, chain[0].Name,
+		)
+		return nil
+	}
+	s.logger.Infof("Restored backup `%s` into `%s`.", backup.Name, s.c.BackupSources)
+	return nil
+}
+
+// extractFile decrypts the given downloaded backup file if needed and
+// extracts it into the configured backup sources.
+func (s *script) extractFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("extractFile: error opening downloaded file: %w", err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if isEncrypted(file) {
+		if r, err = s.decryptArchive(r, file); err != nil {
+			return fmt.Errorf("extractFile: error decrypting backup: %w", err)
+		}
+	}
+
+	if err := extractArchive(r, s.c.BackupSources, s.c.BackupPreserveMetadata, s.logger.Warnf); err != nil {
+		return fmt.Errorf("extractFile: error extracting backup: %w", err)
+	}
+	return nil
+}
+
+// checkDownload checks the signature of the downloaded backup file, so that
+// nothing is restored from backups that have not been signed using one of
+// the configured keys.
+func (s *script) checkDownload(backend storage.Backend, name, file string) error {
+	if s.verificationKeys == nil {
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("checkDownload: error opening downloaded file: %w", err)
+	}
+	defer f.Close()
+	if err := s.checkSignature(backend, name, f); err != nil {
+		return fmt.Errorf("checkDownload: %w", err)
+	}
+	return nil
+}
+
+// findBackup looks up the backup of the given name in all configured storage
+// backends and returns the first match. In case `latest` is given, the most
+// recent backup matching BACKUP_PRUNING_PREFIX across all backends is returned.
+func (s *script) findBackup(name string) (storage.Backend, *storage.Backup, error) {
+	if len(s.storages) == 0 {
+		return nil, nil, errors.New("findBackup: no storage backends configured")
+	}
+
+	prefix := name
+	if name == "latest" {
+		prefix = s.c.BackupPruningPrefix
+	}
+
+	var matchBackend storage.Backend
+	var match *storage.Backup
+	for _, backend := range s.storages {
+		backups, err := backend.List(prefix)
+		if err != nil {
+			return nil, nil, fmt.Errorf("findBackup: error listing backups in storage %s: %w", backend.Name(), err)
+		}
+		// Backups that have been split are looked up using the name of the
+		// archive they have been split from.
+		backups = storage.Select(backups, isBackup)
+		for i, backup := range backups {
+			if name != "latest" && backup.Name == name {
+				return backend, &backups[i], nil
+			}
+			if name == "latest" && (match == nil || backup.LastModified.After(match.LastModified)) {
+				matchBackend, match = backend, &backups[i]
+			}
+		}
+	}
+
+	if match == nil {
+		return nil, nil, fmt.Errorf("findBackup: no backup named `%s` found in any storage", name)
+	}
+	return matchBackend, match, nil
+}
+
+// download writes the given backup in the given backend to the location
+// at dst, joining its parts in case it has been split.
+func download(backend storage.Backend, backup storage.Backup, dst string) error {
+	src, err := openBackup(backend, backup)
+	if err != nil {
+		return fmt.Errorf("download: error opening backup: %w", err)
+	}
+	defer src.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("download: error creating file: %w", err)
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return fmt.Errorf("download: error writing file: %w", err)
+	}
+	return out.Close()
+}
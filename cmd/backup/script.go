@@ -5,12 +5,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"text/template"
 	"time"
 
@@ -21,6 +23,8 @@ import (
 	"github.com/offen/docker-volume-backup/internal/storage/webdav"
 	"github.com/offen/docker-volume-backup/internal/utilities"
 
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/containrrr/shoutrrr"
 	"github.com/containrrr/shoutrrr/pkg/router"
 	"github.com/docker/docker/api/types"
@@ -31,7 +35,6 @@ import (
 	"github.com/leekchan/timeutil"
 	"github.com/otiai10/copy"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/openpgp"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -43,14 +46,35 @@ type script struct {
 	logger    *logrus.Logger
 	sender    *router.ServiceRouter
 	template  *template.Template
+	redactor  *strings.Replacer
 	hooks     []hook
 	hookLevel hookLevel
 
-	file  string
-	stats *Stats
+	file      string
+	parts     []string
+	manifest  *manifest
+	volume    *volumeMetadata
+	checksum  string
+	signature []byte
+	sources   []*source
+	captured  []capturedOutput
+	stats     *Stats
+
+	publicKeys       openpgp.EntityList
+	privateKeys      openpgp.EntityList
+	ageRecipients    []age.Recipient
+	ageRecipientKeys []string
+	ageIdentities    []age.Identity
+
+	signingKey       *openpgp.Entity
+	verificationKeys openpgp.EntityList
 
 	encounteredLock bool
 
+	// command is the command given on the command line, which is used to
+	// pick the notification templates.
+	command string
+
 	c *Config
 }
 
@@ -71,6 +95,7 @@ func newScript() (*script, error) {
 		stats: &Stats{
 			StartTime: time.Now(),
 			LogOutput: logBuffer,
+			Sources:   map[string]BackupFileStats{},
 			Storages: map[string]StorageStats{
 				"S3":     {},
 				"WebDAV": {},
@@ -86,11 +111,19 @@ func newScript() (*script, error) {
 		return nil
 	})
 
+	if err := loadFileValues(s.c); err != nil {
+		return nil, fmt.Errorf("newScript: %w", err)
+	}
 	if err := envconfig.Process("", s.c); err != nil {
 		return nil, fmt.Errorf("newScript: failed to process configuration values: %w", err)
 	}
 
-	s.file = path.Join("/tmp", s.c.BackupFilename)
+	// Sensitive values are redacted from the log output as soon as they are
+	// known, so nothing logged while setting up storage backends leaks them.
+	s.redactor = newRedactor(s.c)
+	stdOut.redactor = s.redactor
+
+	s.file = path.Join(s.c.BackupStagingDirectory, withArchiveExtension(s.c.BackupFilename, s.archiveCompression()))
 	if s.c.BackupFilenameExpand {
 		s.file = os.ExpandEnv(s.file)
 		s.c.BackupLatestSymlink = os.ExpandEnv(s.c.BackupLatestSymlink)
@@ -98,6 +131,37 @@ func newScript() (*script, error) {
 	}
 	s.file = timeutil.Strftime(&s.stats.StartTime, s.file)
 
+	if err := s.validateCompression(); err != nil {
+		return nil, fmt.Errorf("newScript: %w", err)
+	}
+	if s.c.BackupSplitSize > 0 && s.c.BackupLatestSymlink != "" {
+		return nil, errors.New("newScript: BACKUP_LATEST_SYMLINK cannot be used when BACKUP_SPLIT_SIZE is set")
+	}
+	if err := s.validatePerSource(); err != nil {
+		return nil, fmt.Errorf("newScript: %w", err)
+	}
+	if err := s.validateReproducible(); err != nil {
+		return nil, fmt.Errorf("newScript: %w", err)
+	}
+	if err := s.loadEncryption(); err != nil {
+		return nil, fmt.Errorf("newScript: %w", err)
+	}
+	if err := s.loadSigningKeys(); err != nil {
+		return nil, fmt.Errorf("newScript: %w", err)
+	}
+	if s.c.BackupFormat == formatRepository {
+		switch {
+		case s.c.BackupStream, s.c.BackupSplitSize > 0, s.c.BackupIncremental, s.c.BackupLatestSymlink != "":
+			return nil, errors.New("newScript: BACKUP_STREAM, BACKUP_SPLIT_SIZE, BACKUP_INCREMENTAL and BACKUP_LATEST_SYMLINK cannot be used when BACKUP_FORMAT is repository")
+		case s.c.BackupCompression == compressionNone:
+			return nil, errors.New("newScript: BACKUP_COMPRESSION cannot be none when BACKUP_FORMAT is repository")
+		case s.c.AgePassphrase != "":
+			// age derives a key from the passphrase using scrypt for each
+			// object it encrypts, which takes about a second per chunk.
+			return nil, errors.New("newScript: AGE_PASSPHRASE cannot be used when BACKUP_FORMAT is repository, use AGE_PUBLIC_KEYS instead")
+		}
+	}
+
 	_, err := os.Stat("/var/run/docker.sock")
 	_, dockerHostSet := os.LookupEnv("DOCKER_HOST")
 	if !os.IsNotExist(err) || dockerHostSet {
@@ -191,6 +255,9 @@ func newScript() (*script, error) {
 			s.c.EmailNotificationRecipient,
 		)
 		s.c.NotificationURLs = append(s.c.NotificationURLs, emailURL)
+		// The notification URL built from the EMAIL_* keys is sensitive too.
+		s.redactor = newRedactor(s.c)
+		stdOut.redactor = s.redactor
 		s.logger.Warn(
 			"Using EMAIL_* keys for providing notification configuration has been deprecated and will be removed in the next major version.",
 		)
@@ -214,6 +281,7 @@ func newScript() (*script, error) {
 
 		tmpl := template.New("")
 		tmpl.Funcs(templateHelpers)
+		tmpl.Funcs(s.templateHelpers())
 		tmpl, err = tmpl.Parse(defaultNotifications)
 		if err != nil {
 			return nil, fmt.Errorf("newScript: unable to parse default notifications templates: %w", err)
@@ -365,11 +433,72 @@ func (s *script) stopContainers() (func() error, error) {
 	}, stopError
 }
 
+// archiveOptions returns the options for archiving the current backup
+// sources.
+func (s *script) archiveOptions() archiveOptions {
+	return archiveOptions{
+		manifest:     s.manifest,
+		captured:     s.capturedFor(),
+		metadata:     s.c.BackupPreserveMetadata,
+		sqliteDir:    s.sqliteDirectory(),
+		reproducible: s.reproducible(),
+		compression:  s.archiveCompression(),
+		level:        s.c.BackupCompressionLevel,
+		concurrency:  s.c.BackupCompressionWorkers,
+		warn:         s.logger.Warnf,
+	}
+}
+
 // createArchive creates a tar archive of the configured backup location and
 // saves it to disk.
 func (s *script) createArchive() error {
+	backupSources, filesEligibleForBackup, err := s.collectSources()
+	if err != nil {
+		return fmt.Errorf("createArchive: error collecting sources: %w", err)
+	}
+	filesEligibleForBackup, err = s.selectIncremental(backupSources, filesEligibleForBackup)
+	if err != nil {
+		return fmt.Errorf("createArchive: error selecting files: %w", err)
+	}
+
+	tarFile := s.file
+	s.registerHook(hookLevelPlumbing, func(error) error {
+		if err := remove(tarFile); err != nil {
+			return fmt.Errorf("createArchive: error removing tar file: %w", err)
+		}
+		s.logger.Infof("Removed tar file `%s`.", tarFile)
+		return nil
+	})
+
+	if err := createArchive(filesEligibleForBackup, backupSources, tarFile, s.archiveOptions()); err != nil {
+		return fmt.Errorf("createArchive: error compressing backup folder: %w", err)
+	}
+	if err := s.removeVolumeExport(); err != nil {
+		return fmt.Errorf("createArchive: %w", err)
+	}
+
+	if h := s.newChecksumHash(); s.reproducible() && h != nil {
+		if s.checksum, err = fileChecksum(tarFile, h); err != nil {
+			return fmt.Errorf("createArchive: %w", err)
+		}
+	}
+
+	s.logger.Infof("Created backup of `%s` at `%s`.", backupSources, tarFile)
+	return nil
+}
+
+// collectSources returns the location that is to be backed up and all files
+// in it that are eligible for backup. In case BACKUP_FROM_SNAPSHOT is set,
+// a snapshot of the configured sources is created and returned instead.
+func (s *script) collectSources() (string, []string, error) {
 	backupSources := s.c.BackupSources
 
+	if s.volume != nil {
+		if err := s.exportVolume(); err != nil {
+			return "", nil, fmt.Errorf("collectSources: %w", err)
+		}
+	}
+
 	if s.c.BackupFromSnapshot {
 		s.logger.Warn(
 			"Using BACKUP_FROM_SNAPSHOT has been deprecated and will be removed in the next major version.",
@@ -377,7 +506,7 @@ func (s *script) createArchive() error {
 		s.logger.Warn(
 			"Please use `archive-pre` and `archive-post` commands to prepare your backup sources. Refer to the README for an upgrade guide.",
 		)
-		backupSources = filepath.Join("/tmp", s.c.BackupSources)
+		backupSources = filepath.Join(s.c.BackupStagingDirectory, s.c.BackupSources)
 		// copy before compressing guard against a situation where backup folder's content are still growing.
 		s.registerHook(hookLevelPlumbing, func(error) error {
 			if err := remove(backupSources); err != nil {
@@ -390,23 +519,34 @@ func (s *script) createArchive() error {
 			PreserveTimes: true,
 			PreserveOwner: true,
 		}); err != nil {
-			return fmt.Errorf("createArchive: error creating snapshot: %w", err)
+			return "", nil, fmt.Errorf("collectSources: error creating snapshot: %w", err)
 		}
 		s.logger.Infof("Created snapshot of `%s` at `%s`.", s.c.BackupSources, backupSources)
 	}
 
-	tarFile := s.file
-	s.registerHook(hookLevelPlumbing, func(error) error {
-		if err := remove(tarFile); err != nil {
-			return fmt.Errorf("createArchive: error removing tar file: %w", err)
-		}
-		s.logger.Infof("Removed tar file `%s`.", tarFile)
-		return nil
-	})
+	filesEligibleForBackup, err := s.walkSources(backupSources)
+	if err != nil {
+		return "", nil, fmt.Errorf("collectSources: %w", err)
+	}
+
+	return backupSources, filesEligibleForBackup, nil
+}
 
+// walkSources returns all files in the given location that are eligible
+// for backup.
+func (s *script) walkSources(backupSources string) ([]string, error) {
 	backupPath, err := filepath.Abs(stripTrailingSlashes(backupSources))
 	if err != nil {
-		return fmt.Errorf("createArchive: error getting absolute path: %w", err)
+		return nil, fmt.Errorf("walkSources: error getting absolute path: %w", err)
+	}
+
+	matcher, err := newIgnoreMatcher(backupPath, s.c.BackupExcludeGlobs)
+	if err != nil {
+		return nil, fmt.Errorf("walkSources: %w", err)
+	}
+	includes, err := parseIgnoreRules(s.c.BackupIncludeGlobs)
+	if err != nil {
+		return nil, fmt.Errorf("walkSources: error parsing include globs: %w", err)
 	}
 
 	var filesEligibleForBackup []string
@@ -415,51 +555,163 @@ func (s *script) createArchive() error {
 			return err
 		}
 
-		if s.c.BackupExcludeRegexp.Re != nil && s.c.BackupExcludeRegexp.Re.MatchString(path) {
-			return nil
+		// Excluded directories are skipped entirely, so none of their
+		// children end up in the archive. The root itself is always kept.
+		if path != backupPath {
+			excluded := s.c.BackupExcludeRegexp.Re != nil && s.c.BackupExcludeRegexp.Re.MatchString(path)
+			if excluded || matcher.ignored(path, di.IsDir()) {
+				if di.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+		}
+		if di.IsDir() {
+			if err := matcher.load(path); err != nil {
+				return err
+			}
 		}
 		filesEligibleForBackup = append(filesEligibleForBackup, path)
 		return nil
 	}); err != nil {
-		return fmt.Errorf("createArchive: error walking filesystem tree: %w", err)
+		return nil, fmt.Errorf("walkSources: error walking filesystem tree: %w", err)
 	}
 
-	if err := createArchive(filesEligibleForBackup, backupSources, tarFile); err != nil {
-		return fmt.Errorf("createArchive: error compressing backup folder: %w", err)
+	if len(includes) != 0 {
+		filesEligibleForBackup = filterIncluded(backupPath, filesEligibleForBackup, includes)
 	}
+	return filesEligibleForBackup, nil
+}
 
-	s.logger.Infof("Created backup of `%s` at `%s`.", backupSources, tarFile)
+// checkStagingSpace estimates the disk space required for staging the backup
+// and returns an error in case the staging directory does not have enough free
+// space. As the compression ratio cannot be known upfront, the estimate
+// assumes the archive to be as big as all sources combined.
+func (s *script) checkStagingSpace() error {
+	if s.c.BackupSkipSpaceCheck {
+		return nil
+	}
+
+	volumeSizes, err := s.volumeSizes()
+	if err != nil {
+		return fmt.Errorf("checkStagingSpace: %w", err)
+	}
+
+	var sourceSize, largestDatabase, largestVolume uint64
+	if err := s.forEachSource(func() error {
+		// Volumes are exported to the staging directory one at a time and
+		// archived from there. Their size is taken from the Docker daemon as
+		// the export does not exist yet.
+		if s.volume != nil {
+			size := volumeSizes[s.volume.Name]
+			sourceSize += size
+			if size > largestVolume {
+				largestVolume = size
+			}
+			return nil
+		}
+		files, err := s.walkSources(s.c.BackupSources)
+		if err != nil {
+			return fmt.Errorf("error collecting sources: %w", err)
+		}
+		for _, file := range files {
+			fi, err := os.Lstat(file)
+			if err != nil {
+				return fmt.Errorf("error getting file info for %s: %w", file, err)
+			}
+			// Each entry in a tar archive is preceded by a 512 byte header.
+			sourceSize += 512
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+			sourceSize += uint64(fi.Size())
+			if s.sqliteDirectory() != "" && uint64(fi.Size()) > largestDatabase {
+				isDatabase, err := isSQLiteDatabase(file)
+				if err != nil {
+					return fmt.Errorf("error checking for SQLite database %s: %w", file, err)
+				}
+				if isDatabase {
+					largestDatabase = uint64(fi.Size())
+				}
+			}
+		}
+		return nil
+	})(); err != nil {
+		return fmt.Errorf("checkStagingSpace: %w", err)
+	}
+
+	var required uint64
+	if !s.c.BackupStream {
+		required += sourceSize
+		// The unencrypted archive is only removed at the end of the run, so
+		// both versions need to fit at the same time. In repository mode,
+		// chunks are encrypted in memory instead.
+		if s.encrypts() && s.c.BackupFormat != formatRepository {
+			required += sourceSize
+		}
+		// Splitting the archive creates a copy of it.
+		if s.c.BackupSplitSize > 0 {
+			required += sourceSize
+		}
+	}
+	if s.c.BackupFromSnapshot {
+		required += sourceSize
+	}
+	// Consistent copies of SQLite databases and exports of volumes are
+	// created one at a time, also when streaming.
+	required += largestDatabase + largestVolume
+	if required == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(s.c.BackupStagingDirectory, 0755); err != nil {
+		return fmt.Errorf("checkStagingSpace: error creating staging directory: %w", err)
+	}
+	available, ok, err := availableSpace(s.c.BackupStagingDirectory)
+	if err != nil {
+		return fmt.Errorf("checkStagingSpace: %w", err)
+	}
+	if !ok {
+		return nil
+	}
+
+	if available < required {
+		return fmt.Errorf(
+			"checkStagingSpace: staging directory %s has %s of free space, but backing up %s might require up to %s. Free up space, use a different BACKUP_STAGING_DIRECTORY or set BACKUP_SKIP_SPACE_CHECK to skip this check",
+			s.c.BackupStagingDirectory,
+			formatBytes(available, false),
+			s.c.BackupSources,
+			formatBytes(required, false),
+		)
+	}
 	return nil
 }
 
-// encryptArchive encrypts the backup file using PGP and the configured passphrase.
-// In case no passphrase is given it returns early, leaving the backup file
-// untouched.
+// encryptArchive encrypts the backup file using GPG or age and the configured
+// passphrase or public keys. In case neither is given it returns early, leaving
+// the backup file untouched.
 func (s *script) encryptArchive() error {
-	if s.c.GpgPassphrase == "" {
+	if !s.encrypts() {
 		return nil
 	}
 
-	gpgFile := fmt.Sprintf("%s.gpg", s.file)
+	encryptedFile := s.file + s.encryptionExtension()
 	s.registerHook(hookLevelPlumbing, func(error) error {
-		if err := remove(gpgFile); err != nil {
-			return fmt.Errorf("encryptArchive: error removing gpg file: %w", err)
+		if err := remove(encryptedFile); err != nil {
+			return fmt.Errorf("encryptArchive: error removing encrypted file: %w", err)
 		}
-		s.logger.Infof("Removed GPG file `%s`.", gpgFile)
+		s.logger.Infof("Removed encrypted file `%s`.", encryptedFile)
 		return nil
 	})
 
-	outFile, err := os.Create(gpgFile)
+	outFile, err := os.Create(encryptedFile)
 	if err != nil {
 		return fmt.Errorf("encryptArchive: error opening out file: %w", err)
 	}
 	defer outFile.Close()
 
 	_, name := path.Split(s.file)
-	dst, err := openpgp.SymmetricallyEncrypt(outFile, []byte(s.c.GpgPassphrase), &openpgp.FileHints{
-		IsBinary: true,
-		FileName: name,
-	}, nil)
+	dst, err := s.newEncryptionWriter(outFile, name)
 	if err != nil {
 		return fmt.Errorf("encryptArchive: error encrypting backup file: %w", err)
 	}
@@ -474,7 +726,11 @@ func (s *script) encryptArchive() error {
 		return fmt.Errorf("encryptArchive: error writing ciphertext to file: %w", err)
 	}
 
-	s.file = gpgFile
+	s.file = encryptedFile
+	if keys := len(s.publicKeys) + len(s.ageRecipients); keys != 0 {
+		s.logger.Infof("Encrypted backup using %d given public key(s), saving as `%s`.", keys, s.file)
+		return nil
+	}
 	s.logger.Infof("Encrypted backup using given passphrase, saving as `%s`.", s.file)
 	return nil
 }
@@ -483,29 +739,62 @@ func (s *script) encryptArchive() error {
 // as per the given configuration.
 func (s *script) copyArchive() error {
 	_, name := path.Split(s.file)
-	if stat, err := os.Stat(s.file); err != nil {
-		return fmt.Errorf("copyArchive: unable to stat backup file: %w", err)
-	} else {
-		size := stat.Size()
-		s.stats.BackupFile = BackupFileStats{
-			Size:     uint64(size),
-			Name:     name,
-			FullPath: s.file,
+	files := []string{s.file}
+	if len(s.parts) != 0 {
+		files = s.parts
+	}
+
+	var size int64
+	for _, file := range files {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("copyArchive: unable to stat backup file: %w", err)
 		}
+		size += stat.Size()
+	}
+	// After splitting, the backup file itself does not exist anymore, which
+	// is why the first part is reported instead.
+	s.stats.BackupFile = BackupFileStats{
+		Size:     uint64(size),
+		Name:     name,
+		FullPath: files[0],
+	}
+	for _, part := range s.parts {
+		s.stats.BackupFile.Parts = append(s.stats.BackupFile.Parts, path.Base(part))
 	}
 
 	eg := errgroup.Group{}
 	for _, backend := range s.storages {
 		b := backend
 		eg.Go(func() error {
-			return b.Copy(s.file)
+			unchanged, err := s.unchangedIn(b)
+			if err != nil {
+				return err
+			}
+			if unchanged {
+				s.stats.Lock()
+				storageStats := s.stats.Storages[b.Name()]
+				storageStats.Skipped++
+				s.stats.Storages[b.Name()] = storageStats
+				s.stats.Unlock()
+				return nil
+			}
+			for _, file := range files {
+				if err := b.Copy(file); err != nil {
+					return err
+				}
+			}
+			if err := s.putSignature(b, name); err != nil {
+				return err
+			}
+			return s.putChecksum(b, name)
 		})
 	}
 	if err := eg.Wait(); err != nil {
 		return fmt.Errorf("copyArchive: error copying archive: %w", err)
 	}
 
-	return nil
+	return s.saveManifest()
 }
 
 // pruneBackups rotates away backups from local and remote storages using
@@ -516,7 +805,7 @@ func (s *script) pruneBackups() error {
 		return nil
 	}
 
-	deadline := time.Now().AddDate(0, 0, -int(s.c.BackupRetentionDays)).Add(s.c.BackupPruningLeeway)
+	deadline := s.pruningDeadline()
 
 	eg := errgroup.Group{}
 	for _, backend := range s.storages {
@@ -527,10 +816,12 @@ func (s *script) pruneBackups() error {
 				return err
 			}
 			s.stats.Lock()
-			s.stats.Storages[b.Name()] = StorageStats{
-				Total:  stats.Total,
-				Pruned: stats.Pruned,
-			}
+			// When archiving each source on its own, pruning runs once per
+			// source, so stats are summed up.
+			storageStats := s.stats.Storages[b.Name()]
+			storageStats.Total += stats.Total
+			storageStats.Pruned += stats.Pruned
+			s.stats.Storages[b.Name()] = storageStats
 			s.stats.Unlock()
 			return nil
 		})
@@ -543,6 +834,12 @@ func (s *script) pruneBackups() error {
 	return nil
 }
 
+// pruningDeadline returns the point in time before which backups are
+// considered to be eligible for pruning.
+func (s *script) pruningDeadline() time.Time {
+	return time.Now().AddDate(0, 0, -int(s.c.BackupRetentionDays)).Add(s.c.BackupPruningLeeway)
+}
+
 // must exits the script run prematurely in case the given error
 // is non-nil.
 func (s *script) must(err error) {
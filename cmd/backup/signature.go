@@ -0,0 +1,124 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// loadSigningKeys reads the configured keys for signing backups and
+// verifying their signatures.
+func (s *script) loadSigningKeys() error {
+	if s.c.GpgSigningKey != "" {
+		keys, err := readKeyRing(s.c.GpgSigningKey)
+		if err != nil {
+			return fmt.Errorf("loadSigningKeys: error reading GPG_SIGNING_KEY: %w", err)
+		}
+		signer, err := signingEntity(keys, s.c.GpgSigningKeyPassphrase)
+		if err != nil {
+			return fmt.Errorf("loadSigningKeys: %w", err)
+		}
+		s.signingKey = signer
+	}
+	if s.c.GpgVerificationKeyRing != "" {
+		keys, err := readKeyRing(s.c.GpgVerificationKeyRing)
+		if err != nil {
+			return fmt.Errorf("loadSigningKeys: error reading GPG_VERIFICATION_KEY_RING: %w", err)
+		}
+		s.verificationKeys = keys
+	}
+	return nil
+}
+
+// signingEntity returns the first of the given keys that can be used for
+// signing, decrypting its private key using the given passphrase if needed.
+func signingEntity(keys openpgp.EntityList, passphrase string) (*openpgp.Entity, error) {
+	for _, entity := range keys {
+		key, ok := entity.SigningKey(time.Now())
+		if !ok || key.PrivateKey == nil {
+			continue
+		}
+		if key.PrivateKey.Encrypted {
+			if passphrase == "" {
+				return nil, errors.New("signingEntity: signing key is protected by a passphrase, but no GPG_SIGNING_KEY_PASSPHRASE was given")
+			}
+			if err := key.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+				return nil, fmt.Errorf("signingEntity: error decrypting signing key: %w", err)
+			}
+		}
+		return entity, nil
+	}
+	return nil, errors.New("signingEntity: GPG_SIGNING_KEY does not contain a private key that can be used for signing")
+}
+
+// sign returns a detached signature of all data read from r.
+func (s *script) sign(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := openpgp.DetachSign(&buf, s.signingKey, r, nil); err != nil {
+		return nil, fmt.Errorf("sign: error creating signature: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// signArchive creates a detached signature of the processed backup file in
+// case GPG_SIGNING_KEY is set. The signature covers the file as it is stored,
+// so it also covers the concatenation of all parts in case it is split.
+func (s *script) signArchive() error {
+	if s.signingKey == nil {
+		return nil
+	}
+	f, err := os.Open(s.file)
+	if err != nil {
+		return fmt.Errorf("signArchive: error opening backup file: %w", err)
+	}
+	defer f.Close()
+
+	if s.signature, err = s.sign(f); err != nil {
+		return fmt.Errorf("signArchive: %w", err)
+	}
+	s.logger.Infof("Signed backup `%s` using key %X.", s.file, s.signingKey.PrimaryKey.Fingerprint)
+	return nil
+}
+
+// putSignature stores the signature of the current archive next to the
+// backup of the given name in the given storage.
+func (s *script) putSignature(backend storage.Backend, name string) error {
+	if s.signature == nil {
+		return nil
+	}
+	if err := backend.Put(name+storage.SignatureSuffix, bytes.NewReader(s.signature)); err != nil {
+		return fmt.Errorf("putSignature: error storing signature in storage %s: %w", backend.Name(), err)
+	}
+	return nil
+}
+
+// checkSignature checks all data read from r against the signature stored
+// next to the backup of the given name in case GPG_VERIFICATION_KEY_RING is
+// set. Backups without a signature made by one of the given keys are
+// rejected.
+func (s *script) checkSignature(backend storage.Backend, name string, r io.Reader) error {
+	if s.verificationKeys == nil {
+		return nil
+	}
+	signature, err := backend.Open(name + storage.SignatureSuffix)
+	if err != nil {
+		return fmt.Errorf("checkSignature: error opening signature of `%s`, refusing to use unsigned backup: %w", name, err)
+	}
+	defer signature.Close()
+
+	signer, err := openpgp.CheckDetachedSignature(s.verificationKeys, r, signature, nil)
+	if err != nil {
+		return fmt.Errorf("checkSignature: signature of `%s` is invalid: %w", name, err)
+	}
+	s.logger.Infof("Verified signature of `%s` made by key %X.", name, signer.PrimaryKey.Fingerprint)
+	return nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sourcePlaceholder is replaced with the name of the source in
+// BACKUP_FILENAME, BACKUP_PRUNING_PREFIX and BACKUP_MANIFEST_FILE when each
+// source is archived on its own.
+const sourcePlaceholder = "{source}"
+
+// source is a single directory or Docker volume that is archived on its own
+// in case BACKUP_PER_SOURCE is set. It holds all state that is specific to
+// the archive created for it.
+type source struct {
+	name      string
+	path      string
+	file      string
+	parts     []string
+	manifest  *manifest
+	checksum  string
+	signature []byte
+	// volume is set for sources that are Docker volumes, which are exported
+	// to path before being archived.
+	volume *volumeMetadata
+}
+
+// perSource returns whether each source is archived on its own, which is
+// always the case when backing up Docker volumes by label.
+func (s *script) perSource() bool {
+	return s.c.BackupPerSource || len(s.c.BackupPerSourcePaths) != 0 || s.c.BackupVolumeLabel != ""
+}
+
+// validatePerSource checks the configuration for archiving each source on
+// its own. In case no BACKUP_PRUNING_PREFIX is given, it is derived from the
+// part of BACKUP_FILENAME that precedes the timestamp.
+func (s *script) validatePerSource() error {
+	if !s.perSource() {
+		return nil
+	}
+	switch {
+	case !strings.Contains(s.c.BackupFilename, sourcePlaceholder):
+		return fmt.Errorf("validatePerSource: BACKUP_FILENAME needs to contain %s when BACKUP_PER_SOURCE or BACKUP_VOLUME_LABEL is set", sourcePlaceholder)
+	case s.c.BackupLatestSymlink != "":
+		return errors.New("validatePerSource: BACKUP_LATEST_SYMLINK cannot be used when BACKUP_PER_SOURCE is set")
+	case s.c.BackupFormat == formatRepository:
+		return errors.New("validatePerSource: BACKUP_FORMAT cannot be repository when BACKUP_PER_SOURCE is set")
+	}
+
+	if s.c.BackupPruningPrefix == "" {
+		s.c.BackupPruningPrefix, _, _ = strings.Cut(s.c.BackupFilename, "%")
+	}
+	if !strings.Contains(s.c.BackupPruningPrefix, sourcePlaceholder) {
+		return fmt.Errorf(
+			"validatePerSource: BACKUP_PRUNING_PREFIX needs to contain %s when BACKUP_PER_SOURCE or BACKUP_VOLUME_LABEL is set, got %s",
+			sourcePlaceholder, s.c.BackupPruningPrefix,
+		)
+	}
+	return nil
+}
+
+// resolveSources collects all sources that are archived on their own. These
+// are either all directories given in BACKUP_PER_SOURCE_PATHS or each top
+// level directory in BACKUP_SOURCES, plus all Docker volumes matching
+// BACKUP_VOLUME_LABEL. Directories are named after their base name, volumes
+// after their volume name.
+func (s *script) resolveSources() error {
+	if !s.perSource() || s.sources != nil {
+		return nil
+	}
+
+	var paths []string
+	if len(s.c.BackupPerSourcePaths) != 0 {
+		for _, p := range s.c.BackupPerSourcePaths {
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(s.c.BackupSources, p)
+			}
+			paths = append(paths, filepath.Clean(p))
+		}
+	} else {
+		entries, err := os.ReadDir(s.c.BackupSources)
+		// When backing up volumes by label, nothing might be mounted into
+		// BACKUP_SOURCES at all.
+		if err != nil && !(os.IsNotExist(err) && s.c.BackupVolumeLabel != "") {
+			return fmt.Errorf("resolveSources: error reading %s: %w", s.c.BackupSources, err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				s.logger.Warnf("Skipping `%s` as it is not a directory.", filepath.Join(s.c.BackupSources, entry.Name()))
+				continue
+			}
+			paths = append(paths, filepath.Join(s.c.BackupSources, entry.Name()))
+		}
+	}
+
+	candidates, err := s.volumeSources()
+	if err != nil {
+		return fmt.Errorf("resolveSources: %w", err)
+	}
+	for _, p := range paths {
+		candidates = append(candidates, &source{
+			name: filepath.Base(p),
+			path: p,
+			file: strings.ReplaceAll(s.file, sourcePlaceholder, filepath.Base(p)),
+		})
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("resolveSources: no sources found in %s", s.c.BackupSources)
+	}
+
+	var sources []*source
+	for _, src := range candidates {
+		// Backups of different sources are told apart using their prefix, so
+		// no prefix may be the prefix of another one.
+		for _, other := range sources {
+			prefix, otherPrefix := s.sourcePrefix(src), s.sourcePrefix(other)
+			if strings.HasPrefix(prefix, otherPrefix) || strings.HasPrefix(otherPrefix, prefix) {
+				return fmt.Errorf(
+					"resolveSources: backups of sources %s and %s cannot be told apart using BACKUP_PRUNING_PREFIX %s",
+					other.name, src.name, s.c.BackupPruningPrefix,
+				)
+			}
+		}
+		sources = append(sources, src)
+	}
+	s.sources = sources
+	return nil
+}
+
+// sourcePrefix returns the pruning prefix of backups of the given source.
+func (s *script) sourcePrefix(src *source) string {
+	return strings.ReplaceAll(s.c.BackupPruningPrefix, sourcePlaceholder, src.name)
+}
+
+// sourceOf returns the source the backup of the given name has been created
+// from.
+func (s *script) sourceOf(name string) (*source, error) {
+	for _, src := range s.sources {
+		if strings.HasPrefix(name, s.sourcePrefix(src)) {
+			return src, nil
+		}
+	}
+	// Backups of volumes that do not exist anymore are restored into a
+	// volume named after the part of the backup's name matching the
+	// placeholder in BACKUP_PRUNING_PREFIX.
+	if s.c.BackupVolumeLabel != "" {
+		before, after, _ := strings.Cut(s.c.BackupPruningPrefix, sourcePlaceholder)
+		if rest := strings.TrimPrefix(name, before); after != "" && rest != name {
+			if i := strings.Index(rest, after); i > 0 {
+				return s.volumeSource(&volumeMetadata{Name: rest[:i]}), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("sourceOf: backup `%s` does not belong to any of the configured sources", name)
+}
+
+// withSource calls fn with the configuration and all state of the script
+// that is specific to a single archive pointing to the given source. State
+// changed by fn is stored in the source when it returns.
+func (s *script) withSource(src *source, fn func() error) error {
+	sources, prefix, manifestFile := s.c.BackupSources, s.c.BackupPruningPrefix, s.c.BackupManifestFile
+	defer func() {
+		s.c.BackupSources, s.c.BackupPruningPrefix, s.c.BackupManifestFile = sources, prefix, manifestFile
+	}()
+
+	s.c.BackupSources = src.path
+	s.c.BackupPruningPrefix = s.sourcePrefix(src)
+	s.c.BackupManifestFile = sourceManifestFile(manifestFile, src.name)
+	s.file, s.parts, s.manifest, s.checksum, s.signature, s.volume = src.file, src.parts, src.manifest, src.checksum, src.signature, src.volume
+	defer func() {
+		src.file, src.parts, src.manifest, src.checksum, src.signature = s.file, s.parts, s.manifest, s.checksum, s.signature
+		s.volume = nil
+	}()
+	return fn()
+}
+
+// forEachSource returns a function that calls fn once for each source. The
+// size of each archive that is copied is recorded in the stats of its source.
+// In case sources are not archived on their own, fn is returned as is.
+func (s *script) forEachSource(fn func() error) func() error {
+	if !s.perSource() {
+		return fn
+	}
+	return func() error {
+		for _, src := range s.sources {
+			s.stats.BackupFile = BackupFileStats{}
+			if err := s.withSource(src, fn); err != nil {
+				return fmt.Errorf("forEachSource: error processing source %s: %w", src.name, err)
+			}
+			if s.stats.BackupFile.Name != "" {
+				s.stats.Sources[src.name] = s.stats.BackupFile
+			}
+		}
+
+		var total BackupFileStats
+		for _, stats := range s.stats.Sources {
+			total.Size += stats.Size
+		}
+		s.stats.BackupFile = total
+		return nil
+	}
+}
+
+// sourceManifestFile returns the location of the manifest of the given
+// source in case incremental backups are created for each source on its own.
+func sourceManifestFile(manifestFile, name string) string {
+	if strings.Contains(manifestFile, sourcePlaceholder) {
+		return strings.ReplaceAll(manifestFile, sourcePlaceholder, name)
+	}
+	ext := filepath.Ext(manifestFile)
+	return strings.TrimSuffix(manifestFile, ext) + "-" + name + ext
+}
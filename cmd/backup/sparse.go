@@ -0,0 +1,219 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	paxXattrPrefix   = "SCHILY.xattr."
+	paxSparseMajor   = "GNU.sparse.major"
+	tarBlockSize     = 512
+	sparseHeaderName = "GNUSparseFile.0"
+)
+
+// sparseRegion is a region of a sparse file that holds data.
+type sparseRegion struct {
+	offset, length int64
+}
+
+// writeSparseEntry writes the given sparse file to the archive, storing only
+// the given data regions. Entries use the PAX format for sparse files in
+// version 1.0 as defined by GNU tar, which archive/tar can read, but cannot
+// write. This is why the headers of such entries are written as raw blocks.
+func writeSparseEntry(aw *archiveWriter, header *tar.Header, file *os.File, regions []sparseRegion) error {
+	var sparseMap bytes.Buffer
+	entries := regions
+	// In case the file ends with a hole, an empty region at its end makes
+	// sure the file is restored using the correct size.
+	if last := regions[len(regions)-1]; last.offset+last.length < header.Size {
+		entries = append(entries, sparseRegion{offset: header.Size})
+	}
+	fmt.Fprintf(&sparseMap, "%d\n", len(entries))
+	var dataSize int64
+	for _, entry := range entries {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", entry.offset, entry.length)
+		dataSize += entry.length
+	}
+	sparseMap.Write(make([]byte, padding(int64(sparseMap.Len()))))
+	size := int64(sparseMap.Len()) + dataSize
+
+	records := map[string]string{
+		paxSparseMajor:        "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     header.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(header.Size, 10),
+		"size":                strconv.FormatInt(size, 10),
+		"uid":                 strconv.Itoa(header.Uid),
+		"gid":                 strconv.Itoa(header.Gid),
+		"mtime":               strconv.FormatInt(header.ModTime.Unix(), 10),
+	}
+	if header.Uname != "" {
+		records["uname"] = header.Uname
+	}
+	if header.Gname != "" {
+		records["gname"] = header.Gname
+	}
+	for key, value := range header.PAXRecords {
+		records[key] = value
+	}
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pax bytes.Buffer
+	for _, key := range keys {
+		pax.WriteString(paxRecord(key, records[key]))
+	}
+
+	// Readers that do not support sparse files extract the entry using its
+	// header name, which is why it is placed in a dedicated directory.
+	base := path.Base(header.Name)
+	if len(base) > 80 {
+		base = base[:80]
+	}
+
+	if err := aw.tw.Flush(); err != nil {
+		return fmt.Errorf("writeSparseEntry: error flushing tar writer: %w", err)
+	}
+	blocks := [][]byte{
+		rawHeader(path.Join("PaxHeaders.0", base), tar.TypeXHeader, int64(pax.Len()), header),
+		pad(pax.Bytes()),
+		rawHeader(path.Join(sparseHeaderName, base), tar.TypeReg, size, header),
+		sparseMap.Bytes(),
+	}
+	for _, block := range blocks {
+		if _, err := aw.w.Write(block); err != nil {
+			return fmt.Errorf("writeSparseEntry: error writing header: %w", err)
+		}
+	}
+
+	for _, region := range regions {
+		if _, err := io.Copy(aw.w, io.NewSectionReader(file, region.offset, region.length)); err != nil {
+			return fmt.Errorf("writeSparseEntry: error writing data: %w", err)
+		}
+	}
+	if _, err := aw.w.Write(make([]byte, padding(dataSize))); err != nil {
+		return fmt.Errorf("writeSparseEntry: error writing padding: %w", err)
+	}
+	return nil
+}
+
+// rawHeader creates a USTAR header block using the metadata of the given
+// header. Values that do not fit the block are left empty, as they are
+// expected to be passed as PAX records.
+func rawHeader(name string, typeflag byte, size int64, header *tar.Header) []byte {
+	block := make([]byte, tarBlockSize)
+	copy(block[0:100], name)
+	putOctal(block[100:108], header.Mode&07777)
+	putOctal(block[108:116], int64(header.Uid))
+	putOctal(block[116:124], int64(header.Gid))
+	putOctal(block[124:136], size)
+	putOctal(block[136:148], header.ModTime.Unix())
+	block[156] = typeflag
+	copy(block[257:263], "ustar\x00")
+	copy(block[263:265], "00")
+	if len(header.Uname) < 32 {
+		copy(block[265:297], header.Uname)
+	}
+	if len(header.Gname) < 32 {
+		copy(block[297:329], header.Gname)
+	}
+
+	copy(block[148:156], "        ")
+	var checksum int64
+	for _, b := range block {
+		checksum += int64(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", checksum))
+	return block
+}
+
+func putOctal(field []byte, value int64) {
+	octal := strconv.FormatInt(value, 8)
+	if value < 0 || len(octal) > len(field)-1 {
+		return
+	}
+	copy(field, strings.Repeat("0", len(field)-1-len(octal))+octal)
+}
+
+// paxRecord formats a PAX record, which is prefixed with its own length.
+func paxRecord(key, value string) string {
+	const extra = len(" =\n")
+	size := len(key) + len(value) + extra
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + key + "=" + value + "\n"
+	// Adding the length might have added another digit.
+	if len(record) != size {
+		size = len(record)
+		record = strconv.Itoa(size) + " " + key + "=" + value + "\n"
+	}
+	return record
+}
+
+func padding(size int64) int64 {
+	return -size & (tarBlockSize - 1)
+}
+
+func pad(data []byte) []byte {
+	return append(data, make([]byte, padding(int64(len(data))))...)
+}
+
+// isSparse returns whether the given header describes a sparse file.
+func isSparse(header *tar.Header) bool {
+	_, ok := header.PAXRecords[paxSparseMajor]
+	return ok || header.Typeflag == tar.TypeGNUSparse
+}
+
+// headerXattrs returns all extended attributes stored in the given header.
+func headerXattrs(header *tar.Header) map[string]string {
+	xattrs := map[string]string{}
+	for key, value := range header.PAXRecords {
+		if strings.HasPrefix(key, paxXattrPrefix) {
+			xattrs[strings.TrimPrefix(key, paxXattrPrefix)] = value
+		}
+	}
+	return xattrs
+}
+
+// copySparse copies the data read from r to the given file, skipping blocks
+// that contain zeros only so they become holes.
+func copySparse(file *os.File, r io.Reader, size int64) error {
+	buf := make([]byte, 4096)
+	zeros := make([]byte, len(buf))
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zeros[:n]) {
+				if _, err := file.Seek(int64(n), io.SeekCurrent); err != nil {
+					return fmt.Errorf("copySparse: error seeking: %w", err)
+				}
+			} else if _, err := file.Write(buf[:n]); err != nil {
+				return fmt.Errorf("copySparse: error writing: %w", err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("copySparse: error reading: %w", err)
+		}
+	}
+	// Seeking past the end of a file does not extend it, so a hole at the
+	// end of the file needs to be created explicitly.
+	if err := file.Truncate(size); err != nil {
+		return fmt.Errorf("copySparse: error setting size: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+)
+
+// splitArchive splits the backup file into parts of BACKUP_SPLIT_SIZE bytes
+// in case this is configured. The parts replace the original backup file,
+// which is removed once splitting has finished.
+func (s *script) splitArchive() error {
+	if s.c.BackupSplitSize <= 0 {
+		return nil
+	}
+
+	// Parts are tracked locally, so they are removed even if the script
+	// moves on to another archive in the meantime.
+	var parts []string
+	file := s.file
+	s.registerHook(hookLevelPlumbing, func(error) error {
+		for _, part := range parts {
+			if err := remove(part); err != nil {
+				return fmt.Errorf("splitArchive: error removing part: %w", err)
+			}
+		}
+		s.logger.Infof("Removed %d part(s) of backup file `%s`.", len(parts), file)
+		return nil
+	})
+
+	src, err := os.Open(s.file)
+	if err != nil {
+		return fmt.Errorf("splitArchive: error opening backup file: %w", err)
+	}
+	defer src.Close()
+
+	dst := &splitWriter{
+		size: int64(s.c.BackupSplitSize),
+		newPart: func(index int) (io.WriteCloser, error) {
+			part := storage.PartName(s.file, index)
+			parts = append(parts, part)
+			return os.Create(part)
+		},
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.CloseWithError(err)
+		return fmt.Errorf("splitArchive: error writing parts: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("splitArchive: error closing last part: %w", err)
+	}
+	s.parts = parts
+
+	// The parts hold a full copy of the archive, so the original can be
+	// removed right away in order to free up space in the staging directory.
+	if err := remove(s.file); err != nil {
+		return fmt.Errorf("splitArchive: error removing backup file: %w", err)
+	}
+	s.logger.Infof(
+		"Split backup file `%s` into %d part(s) of up to %s.",
+		s.file, len(s.parts), formatBytes(uint64(s.c.BackupSplitSize), false),
+	)
+	return nil
+}
+
+// splitWriter distributes all data written to it across a sequence of parts
+// holding at most size bytes each. A new part is requested from newPart as
+// soon as the current one is full.
+type splitWriter struct {
+	size    int64
+	newPart func(index int) (io.WriteCloser, error)
+	current io.WriteCloser
+	written int64
+	index   int
+}
+
+func (w *splitWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if w.current == nil || w.written >= w.size {
+			if err := w.next(); err != nil {
+				return n, err
+			}
+		}
+		chunk := p
+		if remaining := w.size - w.written; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		m, err := w.current.Write(chunk)
+		n += m
+		w.written += int64(m)
+		p = p[m:]
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (w *splitWriter) next() error {
+	if w.current != nil {
+		if err := w.current.Close(); err != nil {
+			return fmt.Errorf("next: error closing part %d: %w", w.index-1, err)
+		}
+	}
+	part, err := w.newPart(w.index)
+	if err != nil {
+		return fmt.Errorf("next: error creating part %d: %w", w.index, err)
+	}
+	w.current, w.written = part, 0
+	w.index++
+	return nil
+}
+
+// Close closes the current part. In case nothing has been written, a single
+// empty part is created.
+func (w *splitWriter) Close() error {
+	if w.current == nil {
+		if err := w.next(); err != nil {
+			return err
+		}
+	}
+	return w.current.Close()
+}
+
+// CloseWithError aborts the current part in case it supports this, and closes
+// it otherwise.
+func (w *splitWriter) CloseWithError(err error) error {
+	if w.current == nil {
+		return nil
+	}
+	if c, ok := w.current.(interface{ CloseWithError(error) error }); ok {
+		return c.CloseWithError(err)
+	}
+	return w.current.Close()
+}
+
+// openBackup returns a reader yielding the contents of the given backup. In
+// case the backup has been split into parts, the first part is opened right
+// away and all others are opened one after the other while reading.
+func openBackup(backend storage.Backend, backup storage.Backup) (io.ReadCloser, error) {
+	files := backup.Files()
+	first, err := backend.Open(files[0])
+	if err != nil {
+		return nil, fmt.Errorf("openBackup: error opening `%s`: %w", files[0], err)
+	}
+	return &partsReader{open: backend.Open, files: files[1:], current: first}, nil
+}
+
+// partsReader yields the contents of all given files one after the other,
+// opening each file using open once the previous one has been read.
+type partsReader struct {
+	open    func(name string) (io.ReadCloser, error)
+	files   []string
+	current io.ReadCloser
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.files) == 0 {
+				return 0, io.EOF
+			}
+			current, err := r.open(r.files[0])
+			if err != nil {
+				return 0, fmt.Errorf("Read: error opening `%s`: %w", r.files[0], err)
+			}
+			r.current, r.files = current, r.files[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			if closeErr := r.current.Close(); closeErr != nil {
+				return n, closeErr
+			}
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.Close()
+}
@@ -0,0 +1,193 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// sqliteHeader is the magic string each SQLite database file starts with.
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// sqliteJournalSuffixes are appended to the name of a database to name the
+// files SQLite keeps its journals and the shared memory index in.
+var sqliteJournalSuffixes = []string{"-wal", "-shm", "-journal"}
+
+// sqliteDirectory returns the directory consistent copies of SQLite databases
+// are created in while archiving. Volumes backed up by label have already been
+// copied to the staging directory, so databases are archived as is.
+func (s *script) sqliteDirectory() string {
+	if !s.c.BackupSqliteOnlineBackup || s.volume != nil {
+		return ""
+	}
+	return s.c.BackupStagingDirectory
+}
+
+// hasSQLiteHeader returns whether the given file is a SQLite database. The
+// file is rewound before returning.
+func hasSQLiteHeader(f *os.File) (bool, error) {
+	buf := make([]byte, len(sqliteHeader))
+	n, err := io.ReadFull(f, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return false, fmt.Errorf("hasSQLiteHeader: error reading header: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, fmt.Errorf("hasSQLiteHeader: error rewinding file: %w", err)
+	}
+	return n == len(sqliteHeader) && bytes.Equal(buf, sqliteHeader), nil
+}
+
+// isSQLiteDatabase returns whether the file at the given path is a SQLite
+// database.
+func isSQLiteDatabase(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("isSQLiteDatabase: error opening file: %w", err)
+	}
+	defer f.Close()
+	return hasSQLiteHeader(f)
+}
+
+// isSQLiteJournal returns whether the file at the given path belongs to a
+// SQLite database next to it.
+func isSQLiteJournal(path string) bool {
+	for _, suffix := range sqliteJournalSuffixes {
+		database := strings.TrimSuffix(path, suffix)
+		if database == path {
+			continue
+		}
+		f, err := os.Open(database)
+		if err != nil {
+			return false
+		}
+		defer f.Close()
+		ok, _ := hasSQLiteHeader(f)
+		return ok
+	}
+	return false
+}
+
+// writeSQLiteEntry writes a consistent copy of the SQLite database at the
+// given path to the archive, using the given header. The copy is created using
+// `VACUUM INTO`, which reads the database in a single transaction, so it is
+// safe to use while other processes are writing to the database.
+func writeSQLiteEntry(aw *archiveWriter, header *tar.Header, path string) error {
+	f, err := os.CreateTemp(aw.sqliteDir, "sqlite-*.db")
+	if err != nil {
+		return fmt.Errorf("writeSQLiteEntry: error creating temporary file: %w", err)
+	}
+	copyPath := f.Name()
+	f.Close()
+	defer os.Remove(copyPath)
+	// VACUUM INTO requires its target to not exist.
+	if err := os.Remove(copyPath); err != nil {
+		return fmt.Errorf("writeSQLiteEntry: error removing temporary file: %w", err)
+	}
+
+	if err := vacuumInto(path, copyPath, "mode=ro"); err != nil {
+		// Opening the database read-only fails in case it is locked for longer
+		// than the timeout or, for databases in WAL mode, in case the journal
+		// files cannot be created, e.g. on a read-only mount. Opening it as
+		// immutable would skip locking and transactions that are still held in
+		// its journals, so the files are copied instead.
+		aw.warn(
+			"Could not open SQLite database %s read-only, copying its files instead, which is only consistent in case no other process is writing to it: %v",
+			path, err,
+		)
+		if err := copyDatabaseFiles(path, copyPath, aw.sqliteDir); err != nil {
+			return fmt.Errorf("writeSQLiteEntry: %w", err)
+		}
+	}
+
+	copied, err := os.Open(copyPath)
+	if err != nil {
+		return fmt.Errorf("writeSQLiteEntry: error opening copy: %w", err)
+	}
+	defer copied.Close()
+	fi, err := copied.Stat()
+	if err != nil {
+		return fmt.Errorf("writeSQLiteEntry: error getting file info: %w", err)
+	}
+
+	header.Size = fi.Size()
+	if err := aw.tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("writeSQLiteEntry: error writing file info header: %w", err)
+	}
+	if _, err := io.Copy(aw.tw, copied); err != nil {
+		return fmt.Errorf("writeSQLiteEntry: error copying database to tar writer: %w", err)
+	}
+	return nil
+}
+
+// vacuumInto copies the database at src to dst using `VACUUM INTO`, opening
+// src using the given URI parameters.
+func vacuumInto(src, dst, params string) error {
+	uri := (&url.URL{Scheme: "file", Path: src, RawQuery: params}).String()
+	statement := "VACUUM INTO '" + strings.ReplaceAll(dst, "'", "''") + "'"
+	cmd := exec.Command("sqlite3", "-bail", "-cmd", ".timeout 30000", uri, statement)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("vacuumInto: error copying database: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// copyDatabaseFiles copies the database at src and its journals, if any, to
+// a temporary directory in dir and creates a copy of it at dst. The copy
+// includes all transactions held in a write-ahead log, while transactions
+// held in a rollback journal are rolled back.
+func copyDatabaseFiles(src, dst, dir string) error {
+	tmp, err := os.MkdirTemp(dir, "sqlite-*")
+	if err != nil {
+		return fmt.Errorf("copyDatabaseFiles: error creating temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	database := filepath.Join(tmp, "database")
+	if err := copyFile(src, database); err != nil {
+		return fmt.Errorf("copyDatabaseFiles: %w", err)
+	}
+	for _, suffix := range []string{"-wal", "-journal"} {
+		if _, err := os.Stat(src + suffix); os.IsNotExist(err) {
+			continue
+		}
+		if err := copyFile(src+suffix, database+suffix); err != nil {
+			return fmt.Errorf("copyDatabaseFiles: %w", err)
+		}
+	}
+	if err := vacuumInto(database, dst, ""); err != nil {
+		return fmt.Errorf("copyDatabaseFiles: %w", err)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("copyFile: error opening %s: %w", src, err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("copyFile: error creating %s: %w", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("copyFile: error copying %s: %w", src, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("copyFile: error closing %s: %w", dst, err)
+	}
+	return nil
+}
@@ -22,6 +22,7 @@ type BackupFileStats struct {
 	Name     string
 	FullPath string
 	Size     uint64
+	Parts    []string
 }
 
 // StorageStats stats about the status of an archival directory
@@ -29,6 +30,9 @@ type StorageStats struct {
 	Total       uint
 	Pruned      uint
 	PruneErrors uint
+	// Skipped counts the archives that have not been uploaded as they are
+	// identical to the most recent backup in the storage.
+	Skipped uint
 }
 
 // Stats global stats regarding script execution
@@ -41,5 +45,6 @@ type Stats struct {
 	LogOutput  *bytes.Buffer
 	Containers ContainersStats
 	BackupFile BackupFileStats
+	Sources    map[string]BackupFileStats
 	Storages   map[string]StorageStats
 }
@@ -0,0 +1,303 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"sync"
+
+	"github.com/offen/docker-volume-backup/internal/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// streamArchive creates a tar archive of the configured backup location and
+// passes it to all configured storages while it is being created. Archiving,
+// compression, encryption and uploading happen in a single pipeline, so the
+// archive is never staged on disk.
+func (s *script) streamArchive() error {
+	backupSources, filesEligibleForBackup, err := s.collectSources()
+	if err != nil {
+		return fmt.Errorf("streamArchive: error collecting sources: %w", err)
+	}
+	filesEligibleForBackup, err = s.selectIncremental(backupSources, filesEligibleForBackup)
+	if err != nil {
+		return fmt.Errorf("streamArchive: error selecting files: %w", err)
+	}
+
+	_, name := path.Split(s.file)
+	name += s.encryptionExtension()
+
+	// Files that have already been stored when the pipeline fails would be
+	// mistaken for complete backups, so they are removed again.
+	var uploads []*upload
+	completed := false
+	defer func() {
+		if !completed {
+			s.removeUploads(uploads)
+		}
+	}()
+
+	var dst interface {
+		io.WriteCloser
+		CloseWithError(error) error
+	}
+	if s.c.BackupSplitSize > 0 {
+		// Parts are uploaded one after the other as soon as they are full.
+		dst = &splitWriter{
+			size: int64(s.c.BackupSplitSize),
+			newPart: func(index int) (io.WriteCloser, error) {
+				u := newUpload(s.storages, storage.PartName(name, index))
+				uploads = append(uploads, u)
+				return u, nil
+			},
+		}
+	} else {
+		u := newUpload(s.storages, name)
+		uploads = append(uploads, u)
+		dst = u
+	}
+
+	counter := &countingWriter{}
+	mw := []io.Writer{dst, counter}
+
+	var verifier *io.PipeWriter
+	var plain io.Writer
+	eg := errgroup.Group{}
+	if s.c.BackupVerify {
+		pr, pw := io.Pipe()
+		verifier = pw
+		verifyName := name
+		// Archives encrypted using public keys cannot be decrypted on the
+		// backup host, so the unencrypted archive is verified instead.
+		if s.encrypts() && !s.canDecrypt() {
+			plain = pw
+			verifyName = trimEncryptionExtension(name)
+		} else {
+			mw = append(mw, pw)
+		}
+		eg.Go(func() error {
+			err := s.verifyStream(pr, verifyName)
+			pr.CloseWithError(err)
+			return err
+		})
+	}
+
+	// The signature is created while uploading, covering the data exactly as
+	// it is stored. The signer is closed on all paths leaving this function,
+	// so it is always waited for before returning.
+	var signer *io.PipeWriter
+	var signing errgroup.Group
+	defer signing.Wait()
+	if s.signingKey != nil {
+		pr, pw := io.Pipe()
+		signer = pw
+		mw = append(mw, pw)
+		signing.Go(func() error {
+			signature, err := s.sign(pr)
+			pr.CloseWithError(err)
+			if err != nil {
+				return err
+			}
+			s.signature = signature
+			return nil
+		})
+	}
+
+	if err := s.writeStream(filesEligibleForBackup, io.MultiWriter(mw...), plain); err != nil {
+		uploadErr := dst.CloseWithError(err)
+		if verifier != nil {
+			verifier.CloseWithError(err)
+		}
+		if signer != nil {
+			signer.CloseWithError(err)
+		}
+		verifyErr := eg.Wait()
+		// Errors returned by the backends are likely to be the cause of the
+		// failure, so they are preferred.
+		if uploadErr != nil {
+			return fmt.Errorf("streamArchive: error streaming archive: %w", uploadErr)
+		}
+		if verifyErr != nil {
+			return fmt.Errorf("streamArchive: error verifying archive: %w", verifyErr)
+		}
+		return fmt.Errorf("streamArchive: error creating archive: %w", err)
+	}
+	if signer != nil {
+		signer.Close()
+	}
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("streamArchive: error streaming archive: %w", err)
+	}
+	if verifier != nil {
+		verifier.Close()
+	}
+	if err := eg.Wait(); err != nil {
+		return fmt.Errorf("streamArchive: error verifying archive: %w", err)
+	}
+	if err := signing.Wait(); err != nil {
+		return fmt.Errorf("streamArchive: error signing archive: %w", err)
+	}
+	completed = true
+
+	s.stats.BackupFile = BackupFileStats{
+		Size:     counter.n,
+		Name:     name,
+		FullPath: s.streamedLocation(uploads[0].name),
+	}
+	if s.c.BackupSplitSize > 0 {
+		for _, u := range uploads {
+			s.stats.BackupFile.Parts = append(s.stats.BackupFile.Parts, u.name)
+		}
+	}
+	for _, backend := range s.storages {
+		if err := s.putSignature(backend, name); err != nil {
+			return fmt.Errorf("streamArchive: %w", err)
+		}
+		if err := s.putChecksum(backend, name); err != nil {
+			return fmt.Errorf("streamArchive: %w", err)
+		}
+	}
+	s.logger.Infof("Streamed backup of `%s` as `%s` to %d storage(s).", backupSources, name, len(s.storages))
+	if err := s.removeVolumeExport(); err != nil {
+		return fmt.Errorf("streamArchive: %w", err)
+	}
+	return s.saveManifest()
+}
+
+// streamedLocation returns the location of the streamed file of the given
+// name. Nothing is staged when streaming, so this is its location in
+// BACKUP_ARCHIVE in case a local storage is used, and its name otherwise.
+func (s *script) streamedLocation(name string) string {
+	for _, backend := range s.storages {
+		if backend.Name() == "Local" {
+			return path.Join(s.c.BackupArchive, name)
+		}
+	}
+	return name
+}
+
+// writeStream writes the archive of the given files to w, encrypting it in
+// case a passphrase or public keys are configured. In case plain is not nil,
+// the unencrypted archive is written to it as well.
+func (s *script) writeStream(files []string, w io.Writer, plain io.Writer) error {
+	dst := io.WriteCloser(nopWriteCloser{w})
+	if s.encrypts() {
+		var err error
+		_, filename := path.Split(s.file)
+		if dst, err = s.newEncryptionWriter(w, filename); err != nil {
+			return fmt.Errorf("writeStream: error creating encryption writer: %w", err)
+		}
+	}
+
+	// The checksum describes the unencrypted archive, as encryption is not
+	// reproducible.
+	archive := []io.Writer{dst}
+	if plain != nil {
+		archive = append(archive, plain)
+	}
+	var h hash.Hash
+	if s.reproducible() {
+		h = s.newChecksumHash()
+	}
+	if h != nil {
+		archive = append(archive, h)
+	}
+	if err := writeArchive(files, io.MultiWriter(archive...), path.Dir(s.file), s.archiveOptions()); err != nil {
+		return fmt.Errorf("writeStream: error writing archive: %w", err)
+	}
+	if h != nil {
+		_, filename := path.Split(s.file)
+		s.checksum = formatChecksum(h.Sum(nil), filename)
+	}
+
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("writeStream: error closing encryption writer: %w", err)
+	}
+	return nil
+}
+
+// upload passes all data written to it to all given storage backends
+// concurrently, storing it under the given name.
+type upload struct {
+	name  string
+	w     io.Writer
+	pipes []*io.PipeWriter
+	eg    errgroup.Group
+
+	mu     sync.Mutex
+	stored []storage.Backend
+}
+
+func newUpload(backends []storage.Backend, name string) *upload {
+	u := &upload{name: name}
+	var writers []io.Writer
+	for _, backend := range backends {
+		b := backend
+		pr, pw := io.Pipe()
+		u.pipes = append(u.pipes, pw)
+		writers = append(writers, pw)
+		u.eg.Go(func() error {
+			err := b.Put(name, pr)
+			// In case the backend stops reading before the end of the archive,
+			// writing to the pipe would block forever otherwise.
+			pr.CloseWithError(err)
+			if err == nil {
+				u.mu.Lock()
+				u.stored = append(u.stored, b)
+				u.mu.Unlock()
+			}
+			return err
+		})
+	}
+	u.w = io.MultiWriter(writers...)
+	return u
+}
+
+func (u *upload) Write(p []byte) (int, error) {
+	return u.w.Write(p)
+}
+
+// Close signals the end of data to all backends and waits for them to finish.
+func (u *upload) Close() error {
+	return u.CloseWithError(nil)
+}
+
+// CloseWithError aborts all pending uploads using the given error and waits
+// for the backends to return.
+func (u *upload) CloseWithError(err error) error {
+	for _, pw := range u.pipes {
+		pw.CloseWithError(err)
+	}
+	return u.eg.Wait()
+}
+
+// removeUploads deletes the files stored by the given uploads from all
+// backends that have stored them. Uploads are expected to be closed.
+func (s *script) removeUploads(uploads []*upload) {
+	for _, u := range uploads {
+		u.mu.Lock()
+		stored := u.stored
+		u.mu.Unlock()
+		for _, backend := range stored {
+			if err := backend.Delete(u.name); err != nil {
+				s.logger.Warnf("Error removing `%s` from storage %s after streaming failed: %v", u.name, backend.Name(), err)
+				continue
+			}
+			s.logger.Infof("Removed `%s` from storage %s after streaming failed.", u.name, backend.Name())
+		}
+	}
+}
+
+// countingWriter counts the number of bytes written to it.
+type countingWriter struct {
+	n uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += uint64(len(p))
+	return len(p), nil
+}
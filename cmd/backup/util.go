@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 )
 
 var noop = func() error { return nil }
@@ -34,7 +35,7 @@ func remove(location string) error {
 
 // buffer takes an io.Writer and returns a wrapped version of the
 // writer that writes to both the original target as well as the returned buffer
-func buffer(w io.Writer) (io.Writer, *bytes.Buffer) {
+func buffer(w io.Writer) (*bufferingWriter, *bytes.Buffer) {
 	buffering := &bufferingWriter{buf: bytes.Buffer{}, writer: w}
 	return buffering, &buffering.buf
 }
@@ -42,11 +43,20 @@ func buffer(w io.Writer) (io.Writer, *bytes.Buffer) {
 type bufferingWriter struct {
 	buf    bytes.Buffer
 	writer io.Writer
+	// redactor is applied to all data before it is written, once it is set.
+	redactor *strings.Replacer
 }
 
 func (b *bufferingWriter) Write(p []byte) (n int, err error) {
-	if n, err := b.buf.Write(p); err != nil {
+	data := p
+	if b.redactor != nil {
+		data = []byte(b.redactor.Replace(string(p)))
+	}
+	if n, err := b.buf.Write(data); err != nil {
 		return n, fmt.Errorf("(*bufferingWriter).Write: error writing to buffer: %w", err)
 	}
-	return b.writer.Write(p)
+	if _, err := b.writer.Write(data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
@@ -0,0 +1,128 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// verify streams the backup of the given name from the storage backend
+// holding it and checks whether it can be decrypted, decompressed and read
+// in full. Nothing is written to disk while doing so, unless its signature
+// needs to be checked. Passing `latest` verifies the most recent backup.
+func (s *script) verify(name string) error {
+	if name == "" {
+		return errors.New("verify: no backup given, pass the name of a backup or `latest`")
+	}
+
+	backend, backup, err := s.findBackup(name)
+	if err != nil {
+		return fmt.Errorf("verify: error looking up backup: %w", err)
+	}
+
+	if isSnapshot(backup.Name) {
+		src, _, err := s.openSnapshot(backend, *backup)
+		if err != nil {
+			return fmt.Errorf("verify: error opening snapshot: %w", err)
+		}
+		defer src.Close()
+		if err := s.inspectStream(src, backup.Name); err != nil {
+			return fmt.Errorf("verify: error verifying snapshot `%s` in storage %s: %w", backup.Name, backend.Name(), err)
+		}
+		return nil
+	}
+
+	var src io.ReadCloser
+	if s.verificationKeys != nil {
+		// The signature is checked before reading the backup, so that no data
+		// from unknown sources is decrypted or decompressed. The backup is
+		// downloaded once, so that the data that is read is the data whose
+		// signature has been checked.
+		file := path.Join(s.c.BackupStagingDirectory, path.Base(backup.Name))
+		s.registerHook(hookLevelPlumbing, func(error) error {
+			if err := remove(file); err != nil {
+				return fmt.Errorf("verify: error removing downloaded file: %w", err)
+			}
+			s.logger.Infof("Removed downloaded file `%s`.", file)
+			return nil
+		})
+		if err := download(backend, *backup, file); err != nil {
+			return fmt.Errorf("verify: error downloading backup: %w", err)
+		}
+		if err := s.checkDownload(backend, backup.Name, file); err != nil {
+			return fmt.Errorf("verify: error verifying backup `%s` in storage %s: %w", backup.Name, backend.Name(), err)
+		}
+		if src, err = os.Open(file); err != nil {
+			return fmt.Errorf("verify: error opening downloaded file: %w", err)
+		}
+	} else if src, err = openBackup(backend, *backup); err != nil {
+		return fmt.Errorf("verify: error opening backup: %w", err)
+	}
+	defer src.Close()
+
+	if err := s.verifyStream(src, backup.Name); err != nil {
+		return fmt.Errorf("verify: error verifying backup `%s` in storage %s: %w", backup.Name, backend.Name(), err)
+	}
+	return nil
+}
+
+// verifyArchive checks whether the archive that has just been created can be
+// read in full in case BACKUP_VERIFY is set. This allows detecting corrupted
+// archives before they are copied to storages and old backups are pruned.
+func (s *script) verifyArchive() error {
+	if !s.c.BackupVerify {
+		return nil
+	}
+
+	// Archives encrypted using public keys cannot be decrypted on the backup
+	// host, so the unencrypted archive is verified instead. It is only
+	// removed at the end of the run.
+	file := s.file
+	if isEncrypted(file) && !s.canDecrypt() {
+		file = trimEncryptionExtension(file)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("verifyArchive: error opening backup file: %w", err)
+	}
+	defer f.Close()
+
+	if err := s.verifyStream(f, file); err != nil {
+		return fmt.Errorf("verifyArchive: error verifying backup file `%s`: %w", file, err)
+	}
+	return nil
+}
+
+// verifyStream reads the backup of the given name from the given reader,
+// decrypting it if needed, and logs the number of entries and their size.
+func (s *script) verifyStream(r io.Reader, name string) error {
+	if isEncrypted(name) {
+		var err error
+		if r, err = s.decryptArchive(r, name); err != nil {
+			return fmt.Errorf("verifyStream: error decrypting backup: %w", err)
+		}
+	}
+
+	return s.inspectStream(r, name)
+}
+
+// inspectStream reads the unencrypted backup of the given name from the
+// given reader and logs the number of entries and their size.
+func (s *script) inspectStream(r io.Reader, name string) error {
+	entries, size, err := inspectArchive(r)
+	if err != nil {
+		return fmt.Errorf("inspectStream: backup is corrupted: %w", err)
+	}
+
+	s.logger.Infof(
+		"Verified backup `%s`, found %d entries with a total size of %s.",
+		name, entries, formatBytes(size, false),
+	)
+	return nil
+}
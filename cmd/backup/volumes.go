@@ -0,0 +1,308 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// volumeMetadataName is the name of the file holding the metadata of a
+	// volume in the root directory of its archive.
+	volumeMetadataName = ".docker-volume-backup-volume.json"
+	// volumeMountPoint is the location volumes are mounted at in helper
+	// containers.
+	volumeMountPoint = "/volume"
+	// volumeStagingDirectory is the directory in BACKUP_STAGING_DIRECTORY
+	// that volumes are exported to.
+	volumeStagingDirectory = "docker-volume-backup-volumes"
+)
+
+// volumeMetadata describes a Docker volume so that it can be recreated when
+// restoring a backup.
+type volumeMetadata struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver"`
+	DriverOpts map[string]string `json:"driverOpts,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// volumeSources returns a source for each Docker volume matching
+// BACKUP_VOLUME_LABEL.
+func (s *script) volumeSources() ([]*source, error) {
+	if s.c.BackupVolumeLabel == "" {
+		return nil, nil
+	}
+	if s.cli == nil {
+		return nil, errors.New("volumeSources: BACKUP_VOLUME_LABEL is set, but no Docker client is available")
+	}
+
+	res, err := s.cli.VolumeList(context.Background(), filters.NewArgs(filters.KeyValuePair{
+		Key:   "label",
+		Value: s.c.BackupVolumeLabel,
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("volumeSources: error listing volumes: %w", err)
+	}
+	sort.Slice(res.Volumes, func(i, j int) bool {
+		return res.Volumes[i].Name < res.Volumes[j].Name
+	})
+
+	var sources []*source
+	for _, volume := range res.Volumes {
+		sources = append(sources, s.volumeSource(&volumeMetadata{
+			Name:       volume.Name,
+			Driver:     volume.Driver,
+			DriverOpts: volume.Options,
+			Labels:     volume.Labels,
+		}))
+	}
+	return sources, nil
+}
+
+// volumeSource returns the source for the given volume, which is exported
+// to the staging directory before being archived.
+func (s *script) volumeSource(volume *volumeMetadata) *source {
+	return &source{
+		name:   volume.Name,
+		path:   filepath.Join(s.c.BackupStagingDirectory, volumeStagingDirectory, volume.Name),
+		file:   strings.ReplaceAll(s.file, sourcePlaceholder, volume.Name),
+		volume: volume,
+	}
+}
+
+// prepareVolumeDirectory makes sure the directory the current volume is
+// exported to or restored from is empty, and registers a hook removing it
+// after the script has finished.
+func (s *script) prepareVolumeDirectory() error {
+	dir := s.c.BackupSources
+	s.registerHook(hookLevelPlumbing, func(error) error {
+		if err := remove(dir); err != nil {
+			return fmt.Errorf("prepareVolumeDirectory: error removing volume directory: %w", err)
+		}
+		s.logger.Infof("Removed volume directory `%s`.", dir)
+		return nil
+	})
+	if err := remove(dir); err != nil {
+		return fmt.Errorf("prepareVolumeDirectory: %w", err)
+	}
+	return nil
+}
+
+// removeVolumeExport removes the directory the current volume has been
+// exported to as soon as it has been archived, so exports of several volumes
+// do not pile up in the staging directory.
+func (s *script) removeVolumeExport() error {
+	if s.volume == nil {
+		return nil
+	}
+	if err := remove(s.c.BackupSources); err != nil {
+		return fmt.Errorf("removeVolumeExport: error removing volume directory: %w", err)
+	}
+	s.logger.Infof("Removed volume directory `%s`.", s.c.BackupSources)
+	return nil
+}
+
+// volumeSizes returns the size of all Docker volumes as reported by the
+// Docker daemon. Volumes whose size is not known are missing from the result.
+func (s *script) volumeSizes() (map[string]uint64, error) {
+	if s.c.BackupVolumeLabel == "" || s.cli == nil {
+		return nil, nil
+	}
+	usage, err := s.cli.DiskUsage(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("volumeSizes: error getting disk usage: %w", err)
+	}
+	sizes := map[string]uint64{}
+	for _, volume := range usage.Volumes {
+		if volume.UsageData != nil && volume.UsageData.Size >= 0 {
+			sizes[volume.Name] = uint64(volume.UsageData.Size)
+		}
+	}
+	return sizes, nil
+}
+
+// exportVolume copies the contents of the current volume into the staging
+// directory using a helper container that mounts the volume read-only. The
+// metadata of the volume is stored next to its contents so it ends up in
+// the archive.
+func (s *script) exportVolume() error {
+	if err := s.prepareVolumeDirectory(); err != nil {
+		return fmt.Errorf("exportVolume: %w", err)
+	}
+
+	id, removeHelper, err := s.createVolumeHelper(s.volume.Name, true)
+	if err != nil {
+		return fmt.Errorf("exportVolume: %w", err)
+	}
+	defer func() {
+		if err := removeHelper(); err != nil {
+			s.logger.Warnf("Error removing helper container for volume %s: %v", s.volume.Name, err)
+		}
+	}()
+
+	r, _, err := s.cli.CopyFromContainer(context.Background(), id, volumeMountPoint)
+	if err != nil {
+		return fmt.Errorf("exportVolume: error copying from volume %s: %w", s.volume.Name, err)
+	}
+	defer r.Close()
+	if err := extractArchive(r, s.c.BackupSources, s.c.BackupPreserveMetadata, s.logger.Warnf); err != nil {
+		return fmt.Errorf("exportVolume: error extracting volume %s: %w", s.volume.Name, err)
+	}
+
+	b, err := json.Marshal(s.volume)
+	if err != nil {
+		return fmt.Errorf("exportVolume: error marshaling volume metadata: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(s.c.BackupSources, volumeMetadataName), b, 0644); err != nil {
+		return fmt.Errorf("exportVolume: error writing volume metadata: %w", err)
+	}
+
+	s.logger.Infof("Exported volume `%s` to `%s`.", s.volume.Name, s.c.BackupSources)
+	return nil
+}
+
+// importVolume copies the restored contents of the current volume into the
+// volume using a helper container. In case the volume does not exist, it is
+// created using the metadata stored in the archive.
+func (s *script) importVolume() error {
+	metadataFile := filepath.Join(s.c.BackupSources, volumeMetadataName)
+	// The metadata file is part of the restored archive, so it could have
+	// been replaced by a symlink pointing outside of BACKUP_SOURCES.
+	if err := checkSymlinks(s.c.BackupSources, metadataFile); err != nil {
+		return fmt.Errorf("importVolume: refusing to read volume metadata: %w", err)
+	}
+	b, err := os.ReadFile(metadataFile)
+	if err != nil {
+		return fmt.Errorf("importVolume: error reading volume metadata, the backup might not have been taken from a volume: %w", err)
+	}
+	volume := &volumeMetadata{}
+	if err := json.Unmarshal(b, volume); err != nil {
+		return fmt.Errorf("importVolume: error unmarshaling volume metadata: %w", err)
+	}
+	if err := os.Remove(metadataFile); err != nil {
+		return fmt.Errorf("importVolume: error removing volume metadata: %w", err)
+	}
+
+	if _, err := s.cli.VolumeInspect(context.Background(), volume.Name); err != nil {
+		if !client.IsErrNotFound(err) {
+			return fmt.Errorf("importVolume: error inspecting volume %s: %w", volume.Name, err)
+		}
+		if _, err := s.cli.VolumeCreate(context.Background(), volumetypes.VolumeCreateBody{
+			Name:       volume.Name,
+			Driver:     volume.Driver,
+			DriverOpts: volume.DriverOpts,
+			Labels:     volume.Labels,
+		}); err != nil {
+			return fmt.Errorf("importVolume: error creating volume %s: %w", volume.Name, err)
+		}
+		s.logger.Infof("Created missing volume `%s` using driver %s.", volume.Name, volume.Driver)
+	}
+
+	id, removeHelper, err := s.createVolumeHelper(volume.Name, false)
+	if err != nil {
+		return fmt.Errorf("importVolume: %w", err)
+	}
+	defer func() {
+		if err := removeHelper(); err != nil {
+			s.logger.Warnf("Error removing helper container for volume %s: %v", volume.Name, err)
+		}
+	}()
+
+	// Entries are named relative to the root of the volume, which is why the
+	// root directory itself is not part of the archive.
+	var files []string
+	if err := filepath.WalkDir(s.c.BackupSources, func(path string, di fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != s.c.BackupSources {
+			files = append(files, path)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("importVolume: error walking restored files: %w", err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(
+			writeArchive(files, pw, s.c.BackupSources+"/", archiveOptions{
+				metadata:    s.c.BackupPreserveMetadata,
+				compression: compressionNone,
+				concurrency: 1,
+				warn:        s.logger.Warnf,
+			}),
+		)
+	}()
+	if err := s.cli.CopyToContainer(context.Background(), id, volumeMountPoint, pr, types.CopyToContainerOptions{
+		CopyUIDGID: true,
+	}); err != nil {
+		pr.CloseWithError(err)
+		return fmt.Errorf("importVolume: error copying to volume %s: %w", volume.Name, err)
+	}
+
+	s.logger.Infof("Restored contents of volume `%s`.", volume.Name)
+	return nil
+}
+
+// createVolumeHelper creates a container that mounts the volume of the given
+// name, pulling BACKUP_VOLUME_HELPER_IMAGE in case it is not present. The
+// container is never started, as copying files from and to containers works
+// without running them. The returned function removes the container.
+func (s *script) createVolumeHelper(name string, readOnly bool) (string, func() error, error) {
+	ctx := context.Background()
+	image := s.c.BackupVolumeHelperImage
+	if _, _, err := s.cli.ImageInspectWithRaw(ctx, image); err != nil {
+		if !client.IsErrNotFound(err) {
+			return "", noop, fmt.Errorf("createVolumeHelper: error inspecting image %s: %w", image, err)
+		}
+		r, err := s.cli.ImagePull(ctx, image, types.ImagePullOptions{})
+		if err != nil {
+			return "", noop, fmt.Errorf("createVolumeHelper: error pulling image %s: %w", image, err)
+		}
+		// Pulling is only complete once the progress output has been read.
+		_, err = io.Copy(io.Discard, r)
+		r.Close()
+		if err != nil {
+			return "", noop, fmt.Errorf("createVolumeHelper: error pulling image %s: %w", image, err)
+		}
+		s.logger.Infof("Pulled image `%s` for helper containers.", image)
+	}
+
+	resp, err := s.cli.ContainerCreate(ctx, &container.Config{
+		Image:  image,
+		Labels: map[string]string{"docker-volume-backup.helper": "true"},
+	}, &container.HostConfig{
+		Mounts: []mount.Mount{{
+			Type:     mount.TypeVolume,
+			Source:   name,
+			Target:   volumeMountPoint,
+			ReadOnly: readOnly,
+		}},
+	}, nil, nil, "")
+	if err != nil {
+		return "", noop, fmt.Errorf("createVolumeHelper: error creating helper container for volume %s: %w", name, err)
+	}
+
+	return resp.ID, func() error {
+		return s.cli.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true})
+	}, nil
+}
@@ -5,8 +5,21 @@
 
 set -e
 
-if [ ! -d "/etc/dockervolumebackup/conf.d" ]; then
+# BACKUP_CRON_EXPRESSION is used before the backup command runs, so reading it
+# from BACKUP_CRON_EXPRESSION_FILE is handled here.
+read_cron_expression() {
+  if [ -n "${BACKUP_CRON_EXPRESSION_FILE+set}" ]; then
+    if [ -n "${BACKUP_CRON_EXPRESSION+set}" ]; then
+      echo "Both BACKUP_CRON_EXPRESSION and BACKUP_CRON_EXPRESSION_FILE are set, only one of them can be used." >&2
+      exit 1
+    fi
+    BACKUP_CRON_EXPRESSION="$(cat "$BACKUP_CRON_EXPRESSION_FILE")"
+  fi
   BACKUP_CRON_EXPRESSION="${BACKUP_CRON_EXPRESSION:-@daily}"
+}
+
+if [ ! -d "/etc/dockervolumebackup/conf.d" ]; then
+  read_cron_expression
 
   echo "Installing cron.d entry with expression $BACKUP_CRON_EXPRESSION."
   echo "$BACKUP_CRON_EXPRESSION backup 2>&1" | crontab -
@@ -15,10 +28,14 @@ else
 
   crontab -r && crontab /dev/null
   for file in /etc/dockervolumebackup/conf.d/*; do
-    source $file
-    BACKUP_CRON_EXPRESSION="${BACKUP_CRON_EXPRESSION:-@daily}"
-    echo "Appending cron.d entry with expression $BACKUP_CRON_EXPRESSION and configuration file $file"
-    (crontab -l; echo "$BACKUP_CRON_EXPRESSION /bin/sh -c 'set -a; source $file; set +a && backup' 2>&1") | crontab -
+    # Each file is sourced in a subshell, so that a cron expression given
+    # in one file is not combined with a _FILE variant given in another.
+    (
+      source $file
+      read_cron_expression
+      echo "Appending cron.d entry with expression $BACKUP_CRON_EXPRESSION and configuration file $file"
+      (crontab -l; echo "$BACKUP_CRON_EXPRESSION /bin/sh -c 'set -a; source $file; set +a && backup' 2>&1") | crontab -
+    )
   done
 fi
 
@@ -0,0 +1,120 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package storage
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IncrementalMarker is part of the name of every incremental backup. Such a
+// backup only contains changes since the previous backup, so it depends on
+// all backups back to the last full backup.
+const IncrementalMarker = ".incremental"
+
+// FullMarker is part of the name of every full backup that has been taken in
+// incremental mode.
+const FullMarker = ".full"
+
+// chainPattern matches the marker in the name of a backup taken in
+// incremental mode, capturing the ID of its chain and, for incremental
+// backups, its position in the chain.
+var chainPattern = regexp.MustCompile(`(?:\.full-([0-9a-f]+)|\.incremental-([0-9a-f]+)-([0-9]+))(?:\.|$)`)
+
+// ChainMarker returns the marker that is inserted into the name of a backup
+// belonging to the chain of the given ID. The full backup starting a chain
+// has a sequence of 0, the incremental backups following it count up from 1.
+func ChainMarker(id string, sequence int) string {
+	if sequence == 0 {
+		return fmt.Sprintf("%s-%s", FullMarker, id)
+	}
+	return fmt.Sprintf("%s-%s-%04d", IncrementalMarker, id, sequence)
+}
+
+// ParseChainMarker returns the ID of the chain and the sequence contained in
+// the name of the given backup. In case the backup has not been taken in
+// incremental mode, false is returned.
+func ParseChainMarker(name string) (string, int, bool) {
+	match := chainPattern.FindStringSubmatch(path.Base(name))
+	if match == nil {
+		return "", 0, false
+	}
+	if match[1] != "" {
+		return match[1], 0, true
+	}
+	sequence, err := strconv.Atoi(match[3])
+	if err != nil {
+		return "", 0, false
+	}
+	return match[2], sequence, true
+}
+
+// IsIncremental returns whether the backup of the given name is an
+// incremental backup.
+func IsIncremental(name string) bool {
+	return strings.Contains(path.Base(name), IncrementalMarker)
+}
+
+// Chains groups each full backup with all incremental backups depending on
+// it, using the chain ID both carry in their names, and orders each chain by
+// the sequence of its backups, so that the full backup comes first. Backups
+// are never ordered by their modification time, as it might change when
+// backups are copied. Incremental backups whose full backup does not exist
+// form a chain of their own, and backups that have not been taken in
+// incremental mode form a chain on their own each.
+func Chains(backups []Backup) [][]Backup {
+	var chains [][]Backup
+	indices := map[string]int{}
+	sequences := map[string]int{}
+	for _, backup := range backups {
+		id, sequence, ok := ParseChainMarker(backup.Name)
+		if !ok {
+			chains = append(chains, []Backup{backup})
+			continue
+		}
+		// Chain IDs are only unique within a directory.
+		key := path.Join(path.Dir(backup.Name), id)
+		sequences[backup.Name] = sequence
+		i, ok := indices[key]
+		if !ok {
+			indices[key] = len(chains)
+			chains = append(chains, nil)
+			i = len(chains) - 1
+		}
+		chains[i] = append(chains[i], backup)
+	}
+
+	for _, chain := range chains {
+		sort.SliceStable(chain, func(i, j int) bool {
+			return sequences[chain[i].Name] < sequences[chain[j].Name]
+		})
+	}
+	return chains
+}
+
+// Prunable returns all of the given backups that were last modified before
+// the given deadline. As restoring an incremental backup requires all
+// backups it depends on, backups are only returned in case all other backups
+// in their chain are prunable too.
+func Prunable(backups []Backup, deadline time.Time) []Backup {
+	var matches []Backup
+	for _, chain := range Chains(backups) {
+		prunable := true
+		for _, backup := range chain {
+			if !backup.LastModified.Before(deadline) {
+				prunable = false
+				break
+			}
+		}
+		if prunable {
+			matches = append(matches, chain...)
+		}
+	}
+	return matches
+}
@@ -12,7 +12,6 @@ import (
 	"time"
 
 	"github.com/offen/docker-volume-backup/internal/storage"
-	"github.com/offen/docker-volume-backup/internal/utilities"
 )
 
 type localStorage struct {
@@ -51,91 +50,145 @@ func (b *localStorage) Copy(file string) error {
 	}
 	b.Log(storage.LogLevelInfo, b.Name(), "Stored copy of backup `%s` in local archive `%s`.", file, b.DestinationPath)
 
-	if b.latestSymlink != "" {
-		symlink := path.Join(b.DestinationPath, b.latestSymlink)
-		if _, err := os.Lstat(symlink); err == nil {
-			os.Remove(symlink)
-		}
-		if err := os.Symlink(name, symlink); err != nil {
-			return fmt.Errorf("(*localStorage).Copy: error creating latest symlink! %w", err)
-		}
-		b.Log(storage.LogLevelInfo, b.Name(), "Created/Updated symlink `%s` for latest backup.", b.latestSymlink)
+	if err := b.updateLatestSymlink(name); err != nil {
+		return fmt.Errorf("(*localStorage).Copy: %w", err)
 	}
 
 	return nil
 }
 
+// Put writes the data read from r to the local archive using the given name.
+// The file only appears under its name once all data has been written.
+func (b *localStorage) Put(name string, r io.Reader) error {
+	tmp := path.Join(b.DestinationPath, storage.TemporaryName(name))
+	if err := os.MkdirAll(path.Dir(tmp), 0755); err != nil {
+		return fmt.Errorf("(*localStorage).Put: Error creating directory in local archive! %w", err)
+	}
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("(*localStorage).Put: Error creating file in local archive! %w", err)
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("(*localStorage).Put: Error writing file to local archive! %w", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("(*localStorage).Put: Error closing file in local archive! %w", err)
+	}
+	if err := os.Rename(tmp, path.Join(b.DestinationPath, name)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("(*localStorage).Put: Error renaming file in local archive! %w", err)
+	}
+	b.Log(storage.LogLevelInfo, b.Name(), "Stored backup `%s` in local archive `%s`.", name, b.DestinationPath)
+
+	// Sidecars describe the latest backup, they are not the latest backup.
+	if _, ok := storage.ParseSidecarName(name); ok {
+		return nil
+	}
+	if err := b.updateLatestSymlink(name); err != nil {
+		return fmt.Errorf("(*localStorage).Put: %w", err)
+	}
+
+	return nil
+}
+
+// updateLatestSymlink points the configured symlink for the latest backup
+// to the given name. It does nothing in case no symlink is configured.
+func (b *localStorage) updateLatestSymlink(name string) error {
+	if b.latestSymlink == "" {
+		return nil
+	}
+	symlink := path.Join(b.DestinationPath, b.latestSymlink)
+	if _, err := os.Lstat(symlink); err == nil {
+		os.Remove(symlink)
+	}
+	if err := os.Symlink(name, symlink); err != nil {
+		return fmt.Errorf("updateLatestSymlink: error creating latest symlink! %w", err)
+	}
+	b.Log(storage.LogLevelInfo, b.Name(), "Created/Updated symlink `%s` for latest backup.", b.latestSymlink)
+	return nil
+}
+
 // Prune rotates away backups according to the configuration and provided deadline for the local storage backend.
 func (b *localStorage) Prune(deadline time.Time, pruningPrefix string) (*storage.PruneStats, error) {
+	candidates, err := b.List(pruningPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("(*localStorage).Prune: Error listing backups! %w", err)
+	}
+
+	stats, err := b.PruneBackups(b.Name(), candidates, deadline, "local backup(s)", b.Delete)
+	if err != nil {
+		return stats, fmt.Errorf("(*localStorage).Prune: %w", err)
+	}
+
+	return stats, nil
+}
+
+// List returns all backups in the local archive whose name starts with the given prefix.
+// In case the prefix names a subdirectory, files in this directory are listed.
+func (b *localStorage) List(prefix string) ([]storage.Backup, error) {
+	dir, _ := path.Split(prefix)
 	globPattern := path.Join(
 		b.DestinationPath,
-		fmt.Sprintf("%s*", pruningPrefix),
+		fmt.Sprintf("%s*", prefix),
 	)
 	globMatches, err := filepath.Glob(globPattern)
 	if err != nil {
 		return nil, fmt.Errorf(
-			"(*localStorage).Prune: Error looking up matching files using pattern %s: %w",
+			"(*localStorage).List: Error looking up matching files using pattern %s: %w",
 			globPattern,
 			err,
 		)
 	}
 
-	var candidates []string
-	for _, candidate := range globMatches {
-		fi, err := os.Lstat(candidate)
+	var backups []storage.Backup
+	for _, match := range globMatches {
+		fi, err := os.Lstat(match)
 		if err != nil {
 			return nil, fmt.Errorf(
-				"(*localStorage).Prune: Error calling Lstat on file %s: %w",
-				candidate,
+				"(*localStorage).List: Error calling Lstat on file %s: %w",
+				match,
 				err,
 			)
 		}
-
-		if fi.Mode()&os.ModeSymlink != os.ModeSymlink {
-			candidates = append(candidates, candidate)
+		if !fi.Mode().IsRegular() {
+			continue
 		}
+		backups = append(backups, storage.Backup{
+			Name:         path.Join(dir, fi.Name()),
+			Size:         fi.Size(),
+			LastModified: fi.ModTime(),
+		})
 	}
+	return backups, nil
+}
 
-	var matches []string
-	for _, candidate := range candidates {
-		fi, err := os.Stat(candidate)
-		if err != nil {
-			return nil, fmt.Errorf(
-				"(*localStorage).Prune: Error calling stat on file %s! %w",
-				candidate,
-				err,
-			)
-		}
-		if fi.ModTime().Before(deadline) {
-			matches = append(matches, candidate)
-		}
+// Open returns a reader for the backup of the given name in the local archive.
+func (b *localStorage) Open(name string) (io.ReadCloser, error) {
+	f, err := os.Open(path.Join(b.DestinationPath, name))
+	if err != nil {
+		return nil, fmt.Errorf("(*localStorage).Open: Error opening file from local archive! %w", err)
 	}
+	return f, nil
+}
 
-	stats := &storage.PruneStats{
-		Total:  uint(len(candidates)),
-		Pruned: uint(len(matches)),
+// Delete removes the backup of the given name from the local archive.
+func (b *localStorage) Delete(name string) error {
+	if err := os.Remove(path.Join(b.DestinationPath, name)); err != nil {
+		return fmt.Errorf("(*localStorage).Delete: Error removing file from local archive! %w", err)
 	}
-
-	if err := b.DoPrune(b.Name(), len(matches), len(candidates), "local backup(s)", func() error {
-		var removeErrors []error
-		for _, match := range matches {
-			if err := os.Remove(match); err != nil {
-				removeErrors = append(removeErrors, err)
+	// The symlink for the latest backup would be dangling otherwise.
+	if b.latestSymlink != "" {
+		symlink := path.Join(b.DestinationPath, b.latestSymlink)
+		if target, err := os.Readlink(symlink); err == nil && target == name {
+			if err := os.Remove(symlink); err != nil {
+				return fmt.Errorf("(*localStorage).Delete: Error removing latest symlink! %w", err)
 			}
 		}
-		if len(removeErrors) != 0 {
-			return fmt.Errorf(
-				"(*localStorage).Prune: %d error(s) deleting local files, starting with: %w",
-				len(removeErrors),
-				utilities.Join(removeErrors...),
-			)
-		}
-		return nil
-	}); err != nil {
-		return stats, err
 	}
-
-	return stats, nil
+	return nil
 }
 
 // copy creates a copy of the file located at `dst` at `src`.
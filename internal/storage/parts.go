@@ -0,0 +1,116 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+var partPattern = regexp.MustCompile(`^(.+)\.part(\d{3,})$`)
+
+// PartName returns the name of the part with the given index (starting at 0)
+// of a backup that has been split into multiple files.
+func PartName(name string, index int) string {
+	return fmt.Sprintf("%s.part%03d", name, index)
+}
+
+// ParsePartName returns the name of the backup and the index of the part in
+// case the given name is the name of a part created using PartName.
+func ParsePartName(name string) (string, int, bool) {
+	match := partPattern.FindStringSubmatch(name)
+	if match == nil {
+		return name, 0, false
+	}
+	index, err := strconv.Atoi(match[2])
+	if err != nil {
+		return name, 0, false
+	}
+	return match[1], index, true
+}
+
+// Group merges all parts of backups that have been split into multiple files
+// into a single backup that is named like the original file. The size of
+// such a backup is the sum of the size of its parts, its modification time is
+// the one of its most recently modified part. Sidecars are attached to the
+// backup they belong to and not returned on their own. Other backups are
+// returned as is.
+func Group(backups []Backup) []Backup {
+	var result []Backup
+	indices := map[string]int{}
+	partIndices := map[string]int{}
+	var sidecars []string
+	for _, backup := range backups {
+		if _, ok := ParseSidecarName(backup.Name); ok {
+			sidecars = append(sidecars, backup.Name)
+			continue
+		}
+		name, partIndex, isPart := ParsePartName(backup.Name)
+		if !isPart {
+			result = append(result, backup)
+			continue
+		}
+		partIndices[backup.Name] = partIndex
+		i, ok := indices[name]
+		if !ok {
+			indices[name] = len(result)
+			result = append(result, Backup{
+				Name:         name,
+				LastModified: backup.LastModified,
+				Metadata:     backup.Metadata,
+			})
+			i = len(result) - 1
+		}
+		group := &result[i]
+		group.Size += backup.Size
+		group.Parts = append(group.Parts, backup.Name)
+		if backup.LastModified.After(group.LastModified) {
+			group.LastModified = backup.LastModified
+		}
+	}
+
+	// Sidecars of backups that do not exist anymore are left alone, as they
+	// cannot be pruned along with their backup.
+	byName := map[string]int{}
+	for i, backup := range result {
+		byName[backup.Name] = i
+	}
+	for _, sidecar := range sidecars {
+		name, _ := ParseSidecarName(sidecar)
+		if i, ok := byName[name]; ok {
+			result[i].Sidecars = append(result[i].Sidecars, sidecar)
+		}
+	}
+
+	for i := range result {
+		parts := result[i].Parts
+		sort.Slice(parts, func(a, b int) bool {
+			return partIndices[parts[a]] < partIndices[parts[b]]
+		})
+	}
+	return result
+}
+
+// Files returns the names of all files that make up the backup.
+func (b Backup) Files() []string {
+	if len(b.Parts) != 0 {
+		return b.Parts
+	}
+	return []string{b.Name}
+}
+
+// Select groups the given backups and returns the ones isBackup reports to
+// be backups. Storages might hold files that have not been created by this
+// tool, especially when no pruning prefix is set, which are not listed.
+func Select(backups []Backup, isBackup func(name string) bool) []Backup {
+	var result []Backup
+	for _, backup := range Group(backups) {
+		if isBackup(backup.Name) {
+			result = append(result, backup)
+		}
+	}
+	return result
+}
@@ -7,14 +7,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/offen/docker-volume-backup/internal/storage"
-	"github.com/offen/docker-volume-backup/internal/utilities"
 )
 
 type s3Storage struct {
@@ -97,7 +98,7 @@ func (b *s3Storage) Copy(file string) error {
 	_, name := path.Split(file)
 
 	if _, err := b.client.FPutObject(context.Background(), b.bucket, filepath.Join(b.DestinationPath, name), file, minio.PutObjectOptions{
-		ContentType:  "application/tar+gzip",
+		ContentType:  contentType(name),
 		StorageClass: b.storageClass,
 	}); err != nil {
 		errResp := minio.ToErrorResponse(err)
@@ -108,56 +109,118 @@ func (b *s3Storage) Copy(file string) error {
 	return nil
 }
 
+// streamPartSize is the size of the parts used when uploading data of unknown
+// length. As S3 allows for 10,000 parts per upload, this limits the size of
+// a single streamed backup to roughly 156 GiB.
+const streamPartSize = 16 * 1024 * 1024
+
+// Put uploads the data read from r to the S3/Minio storage backend using the
+// given name. As the size of the data is unknown, a multipart upload is used.
+func (b *s3Storage) Put(name string, r io.Reader) error {
+	if _, err := b.client.PutObject(context.Background(), b.bucket, filepath.Join(b.DestinationPath, name), r, -1, minio.PutObjectOptions{
+		ContentType:  contentType(name),
+		StorageClass: b.storageClass,
+		PartSize:     streamPartSize,
+	}); err != nil {
+		errResp := minio.ToErrorResponse(err)
+		return fmt.Errorf("(*s3Storage).Put: error uploading backup to remote storage: [Message]: '%s', [Code]: %s, [StatusCode]: %d", errResp.Message, errResp.Code, errResp.StatusCode)
+	}
+	b.Log(storage.LogLevelInfo, b.Name(), "Uploaded backup `%s` to bucket `%s`.", name, b.bucket)
+
+	return nil
+}
+
+// contentType returns the MIME type of the backup of the given name based on
+// the extension of its archive.
+func contentType(name string) string {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".gpg"), ".age")
+	switch {
+	case strings.HasSuffix(name, ".tar.zst"):
+		return "application/tar+zstd"
+	case strings.HasSuffix(name, ".tar.xz"):
+		return "application/tar+xz"
+	case strings.HasSuffix(name, ".tar"):
+		return "application/x-tar"
+	default:
+		return "application/tar+gzip"
+	}
+}
+
 // Prune rotates away backups according to the configuration and provided deadline for the S3/Minio storage backend.
 func (b *s3Storage) Prune(deadline time.Time, pruningPrefix string) (*storage.PruneStats, error) {
-	candidates := b.client.ListObjects(context.Background(), b.bucket, minio.ListObjectsOptions{
-		WithMetadata: true,
-		Prefix:       filepath.Join(b.DestinationPath, pruningPrefix),
-		Recursive:    true,
+	candidates, err := b.List(pruningPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("(*s3Storage).Prune: Error looking up candidates from remote storage! %w", err)
+	}
+
+	stats, err := b.PruneBackups(b.Name(), candidates, deadline, "remote backup(s)", b.Delete)
+	if err != nil {
+		return stats, fmt.Errorf("(*s3Storage).Prune: %w", err)
+	}
+
+	return stats, nil
+}
+
+// List returns all backups in the bucket whose name starts with the given prefix.
+// In case the prefix names a subdirectory, files in this directory are listed.
+func (b *s3Storage) List(prefix string) ([]storage.Backup, error) {
+	dir, filePrefix := path.Split(prefix)
+	keyPrefix := path.Join(b.DestinationPath, dir)
+	if keyPrefix != "" {
+		keyPrefix += "/"
+	}
+	objects := b.client.ListObjects(context.Background(), b.bucket, minio.ListObjectsOptions{
+		Prefix:    keyPrefix + filePrefix,
+		Recursive: false,
 	})
 
-	var matches []minio.ObjectInfo
-	var lenCandidates int
-	for candidate := range candidates {
-		lenCandidates++
-		if candidate.Err != nil {
+	var backups []storage.Backup
+	for object := range objects {
+		if object.Err != nil {
 			return nil, fmt.Errorf(
-				"(*s3Storage).Prune: Error looking up candidates from remote storage! %w",
-				candidate.Err,
+				"(*s3Storage).List: Error looking up backups from remote storage! %w",
+				object.Err,
 			)
 		}
-		if candidate.LastModified.Before(deadline) {
-			matches = append(matches, candidate)
+		// Listing non-recursively returns objects in subdirectories as
+		// common prefixes, which are skipped like directories elsewhere.
+		if strings.HasSuffix(object.Key, "/") {
+			continue
+		}
+		backup := storage.Backup{
+			Name:         path.Join(dir, strings.TrimPrefix(object.Key, keyPrefix)),
+			Size:         object.Size,
+			LastModified: object.LastModified,
 		}
+		if object.ETag != "" {
+			backup.Metadata = map[string]string{storage.MetadataETag: object.ETag}
+		}
+		backups = append(backups, backup)
 	}
+	return backups, nil
+}
 
-	stats := &storage.PruneStats{
-		Total:  uint(lenCandidates),
-		Pruned: uint(len(matches)),
+// Open returns a reader for the backup of the given name in the bucket.
+func (b *s3Storage) Open(name string) (io.ReadCloser, error) {
+	object, err := b.client.GetObject(context.Background(), b.bucket, filepath.Join(b.DestinationPath, name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("(*s3Storage).Open: Error requesting backup from remote storage! %w", err)
 	}
-
-	if err := b.DoPrune(b.Name(), len(matches), lenCandidates, "remote backup(s)", func() error {
-		objectsCh := make(chan minio.ObjectInfo)
-		go func() {
-			for _, match := range matches {
-				objectsCh <- match
-			}
-			close(objectsCh)
-		}()
-		errChan := b.client.RemoveObjects(context.Background(), b.bucket, objectsCh, minio.RemoveObjectsOptions{})
-		var removeErrors []error
-		for result := range errChan {
-			if result.Err != nil {
-				removeErrors = append(removeErrors, result.Err)
-			}
-		}
-		if len(removeErrors) != 0 {
-			return utilities.Join(removeErrors...)
-		}
-		return nil
-	}); err != nil {
-		return stats, err
+	// GetObject does not perform any request before the object is read from,
+	// so calling Stat is used to surface errors like missing objects early.
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		errResp := minio.ToErrorResponse(err)
+		return nil, fmt.Errorf("(*s3Storage).Open: error downloading backup from remote storage: [Message]: '%s', [Code]: %s, [StatusCode]: %d", errResp.Message, errResp.Code, errResp.StatusCode)
 	}
+	return object, nil
+}
 
-	return stats, nil
+// Delete removes the backup of the given name from the bucket.
+func (b *s3Storage) Delete(name string) error {
+	if err := b.client.RemoveObject(context.Background(), b.bucket, filepath.Join(b.DestinationPath, name), minio.RemoveObjectOptions{}); err != nil {
+		errResp := minio.ToErrorResponse(err)
+		return fmt.Errorf("(*s3Storage).Delete: error removing backup from remote storage: [Message]: '%s', [Code]: %s, [StatusCode]: %d", errResp.Message, errResp.Code, errResp.StatusCode)
+	}
+	return nil
 }
@@ -0,0 +1,29 @@
+// Copyright 2022 - Offen Authors <hioffen@posteo.de>
+// SPDX-License-Identifier: MPL-2.0
+
+package storage
+
+import "strings"
+
+// ChecksumSuffix is appended to the name of a backup to name the file holding
+// the SHA-256 checksum of its contents.
+const ChecksumSuffix = ".sha256"
+
+// SignatureSuffix is appended to the name of a backup to name the file holding
+// a detached OpenPGP signature of its contents.
+const SignatureSuffix = ".sig"
+
+// sidecarSuffixes lists the suffixes of all files that are stored next to a
+// backup and describe it.
+var sidecarSuffixes = []string{ChecksumSuffix, SignatureSuffix}
+
+// ParseSidecarName returns the name of the backup the file of the given name
+// belongs to in case it is a sidecar.
+func ParseSidecarName(name string) (string, bool) {
+	for _, suffix := range sidecarSuffixes {
+		if backup := strings.TrimSuffix(name, suffix); backup != name && backup != "" {
+			return backup, true
+		}
+	}
+	return name, false
+}
@@ -153,38 +153,90 @@ func (b *sshStorage) Copy(file string) error {
 	return nil
 }
 
+// Put writes the data read from r to the SSH storage backend using the given name.
+func (b *sshStorage) Put(name string, r io.Reader) error {
+	tmp := filepath.Join(b.DestinationPath, storage.TemporaryName(name))
+	if err := b.sftpClient.MkdirAll(filepath.Dir(tmp)); err != nil {
+		return fmt.Errorf("(*sshStorage).Put: Error creating directory on SSH storage! %w", err)
+	}
+	destination, err := b.sftpClient.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("(*sshStorage).Put: Error creating file on SSH storage! %w", err)
+	}
+
+	if _, err := io.Copy(destination, r); err != nil {
+		destination.Close()
+		b.sftpClient.Remove(tmp)
+		return fmt.Errorf("(*sshStorage).Put: Error uploading the file to SSH storage! %w", err)
+	}
+	if err := destination.Close(); err != nil {
+		b.sftpClient.Remove(tmp)
+		return fmt.Errorf("(*sshStorage).Put: Error closing the file on SSH storage! %w", err)
+	}
+	if err := b.sftpClient.PosixRename(tmp, filepath.Join(b.DestinationPath, name)); err != nil {
+		b.sftpClient.Remove(tmp)
+		return fmt.Errorf("(*sshStorage).Put: Error renaming the file on SSH storage! %w", err)
+	}
+
+	b.Log(storage.LogLevelInfo, b.Name(), "Uploaded backup `%s` to SSH storage '%s' at path '%s'.", name, b.hostName, b.DestinationPath)
+
+	return nil
+}
+
 // Prune rotates away backups according to the configuration and provided deadline for the SSH storage backend.
 func (b *sshStorage) Prune(deadline time.Time, pruningPrefix string) (*storage.PruneStats, error) {
-	candidates, err := b.sftpClient.ReadDir(b.DestinationPath)
+	candidates, err := b.List(pruningPrefix)
 	if err != nil {
 		return nil, fmt.Errorf("(*sshStorage).Prune: Error reading directory from SSH storage! %w", err)
 	}
 
-	var matches []string
+	stats, err := b.PruneBackups(b.Name(), candidates, deadline, "SSH backup(s)", b.Delete)
+	if err != nil {
+		return stats, fmt.Errorf("(*sshStorage).Prune: %w", err)
+	}
+
+	return stats, nil
+}
+
+// List returns all backups on the SSH storage whose name starts with the given prefix.
+// In case the prefix names a subdirectory, files in this directory are listed.
+func (b *sshStorage) List(prefix string) ([]storage.Backup, error) {
+	dir, filePrefix := path.Split(prefix)
+	candidates, err := b.sftpClient.ReadDir(filepath.Join(b.DestinationPath, dir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("(*sshStorage).List: Error reading directory from SSH storage! %w", err)
+	}
+
+	var backups []storage.Backup
 	for _, candidate := range candidates {
-		if !strings.HasPrefix(candidate.Name(), pruningPrefix) {
+		if !candidate.Mode().IsRegular() || !strings.HasPrefix(candidate.Name(), filePrefix) {
 			continue
 		}
-		if candidate.ModTime().Before(deadline) {
-			matches = append(matches, candidate.Name())
-		}
+		backups = append(backups, storage.Backup{
+			Name:         path.Join(dir, candidate.Name()),
+			Size:         candidate.Size(),
+			LastModified: candidate.ModTime(),
+		})
 	}
+	return backups, nil
+}
 
-	stats := &storage.PruneStats{
-		Total:  uint(len(candidates)),
-		Pruned: uint(len(matches)),
+// Open returns a reader for the backup of the given name on the SSH storage.
+func (b *sshStorage) Open(name string) (io.ReadCloser, error) {
+	f, err := b.sftpClient.Open(filepath.Join(b.DestinationPath, name))
+	if err != nil {
+		return nil, fmt.Errorf("(*sshStorage).Open: Error opening file on SSH storage! %w", err)
 	}
+	return f, nil
+}
 
-	if err := b.DoPrune(b.Name(), len(matches), len(candidates), "SSH backup(s)", func() error {
-		for _, match := range matches {
-			if err := b.sftpClient.Remove(filepath.Join(b.DestinationPath, match)); err != nil {
-				return fmt.Errorf("(*sshStorage).Prune: Error removing file from SSH storage! %w", err)
-			}
-		}
-		return nil
-	}); err != nil {
-		return stats, err
+// Delete removes the backup of the given name from the SSH storage.
+func (b *sshStorage) Delete(name string) error {
+	if err := b.sftpClient.Remove(filepath.Join(b.DestinationPath, name)); err != nil {
+		return fmt.Errorf("(*sshStorage).Delete: Error removing file from SSH storage! %w", err)
 	}
-
-	return stats, nil
+	return nil
 }
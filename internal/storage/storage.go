@@ -4,16 +4,59 @@
 package storage
 
 import (
+	"fmt"
+	"io"
+	"path"
 	"time"
+
+	"github.com/offen/docker-volume-backup/internal/utilities"
 )
 
 // Backend is an interface for defining functions which all storage providers support.
+// List returns the files directly inside the directory named by the part of
+// the prefix up to its last slash whose names start with the rest of the
+// prefix. Subdirectories are skipped and never descended into.
 type Backend interface {
 	Copy(file string) error
+	Put(name string, r io.Reader) error
 	Prune(deadline time.Time, pruningPrefix string) (*PruneStats, error)
+	List(prefix string) ([]Backup, error)
+	Open(name string) (io.ReadCloser, error)
+	Delete(name string) error
 	Name() string
 }
 
+// Backup describes a single backup file that is held by a storage backend.
+// Names are relative to the backend's destination path and can be passed
+// to Open and Delete. Metadata holds the keys listed below in case the
+// backend reports them when listing files, and is nil otherwise.
+type Backup struct {
+	Name         string
+	Size         int64
+	LastModified time.Time
+	Metadata     map[string]string
+	// Parts holds the names of all parts in case the backup has been split
+	// into multiple files. It is only populated by Group.
+	Parts []string
+	// Sidecars holds the names of all files stored next to the backup that
+	// describe it, e.g. its checksum. It is only populated by Group.
+	Sidecars []string
+}
+
+// MetadataETag is the key of the entity tag of a file in Backup.Metadata,
+// which changes whenever the contents of the file change. It is set by the
+// s3 and webdav backends.
+const MetadataETag = "ETag"
+
+// TemporaryName returns the name a backup of the given name is stored under
+// while it is being written. Backends rename it to its final name only once
+// all data has been written, so incomplete uploads are never mistaken for
+// backups.
+func TemporaryName(name string) string {
+	dir, file := path.Split(name)
+	return dir + "." + file + ".tmp"
+}
+
 // StorageBackend is a generic type of storage. Everything here are common properties of all storage types.
 type StorageBackend struct {
 	DestinationPath string
@@ -59,3 +102,41 @@ func (b *StorageBackend) DoPrune(context string, lenMatches, lenCandidates int,
 	}
 	return nil
 }
+
+// PruneBackups picks the given backups that are prunable given the deadline
+// and removes all of their files using the given function. Backups that have
+// been split into multiple parts are counted and pruned as a single backup,
+// together with their sidecars. Full backups are kept as long as incremental
+// backups depending on them are kept.
+func (b *StorageBackend) PruneBackups(context string, backups []Backup, deadline time.Time, description string, remove func(name string) error) (*PruneStats, error) {
+	candidates := Group(backups)
+	matches := Prunable(candidates, deadline)
+
+	stats := &PruneStats{
+		Total:  uint(len(candidates)),
+		Pruned: uint(len(matches)),
+	}
+
+	if err := b.DoPrune(context, len(matches), len(candidates), description, func() error {
+		var removeErrors []error
+		for _, match := range matches {
+			for _, name := range append(match.Files(), match.Sidecars...) {
+				if err := remove(name); err != nil {
+					removeErrors = append(removeErrors, err)
+				}
+			}
+		}
+		if len(removeErrors) != 0 {
+			return fmt.Errorf(
+				"PruneBackups: %d error(s) removing files, starting with: %w",
+				len(removeErrors),
+				utilities.Join(removeErrors...),
+			)
+		}
+		return nil
+	}); err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
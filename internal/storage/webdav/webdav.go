@@ -6,7 +6,7 @@ package webdav
 import (
 	"errors"
 	"fmt"
-	"io/fs"
+	"io"
 	"net/http"
 	"os"
 	"path"
@@ -83,39 +83,83 @@ func (b *webDavStorage) Copy(file string) error {
 	return nil
 }
 
+// Put uploads the data read from r to the WebDav storage backend using the given name.
+func (b *webDavStorage) Put(name string, r io.Reader) error {
+	tmp := filepath.Join(b.DestinationPath, storage.TemporaryName(name))
+	if err := b.client.MkdirAll(filepath.Dir(tmp), 0644); err != nil {
+		return fmt.Errorf("(*webDavStorage).Put: Error creating directory '%s' on WebDAV server! %w", filepath.Dir(tmp), err)
+	}
+	if err := b.client.WriteStream(tmp, r, 0644); err != nil {
+		b.client.Remove(tmp)
+		return fmt.Errorf("(*webDavStorage).Put: Error uploading the file to WebDAV server! %w", err)
+	}
+	if err := b.client.Rename(tmp, filepath.Join(b.DestinationPath, name), true); err != nil {
+		b.client.Remove(tmp)
+		return fmt.Errorf("(*webDavStorage).Put: Error renaming the file on WebDAV server! %w", err)
+	}
+	b.Log(storage.LogLevelInfo, b.Name(), "Uploaded backup `%s` to WebDAV-URL '%s' at path '%s'.", name, b.url, b.DestinationPath)
+
+	return nil
+}
+
 // Prune rotates away backups according to the configuration and provided deadline for the WebDav storage backend.
 func (b *webDavStorage) Prune(deadline time.Time, pruningPrefix string) (*storage.PruneStats, error) {
-	candidates, err := b.client.ReadDir(b.DestinationPath)
+	candidates, err := b.List(pruningPrefix)
 	if err != nil {
 		return nil, fmt.Errorf("(*webDavStorage).Prune: Error looking up candidates from remote storage! %w", err)
 	}
-	var matches []fs.FileInfo
-	var lenCandidates int
+
+	stats, err := b.PruneBackups(b.Name(), candidates, deadline, "WebDAV backup(s)", b.Delete)
+	if err != nil {
+		return stats, fmt.Errorf("(*webDavStorage).Prune: %w", err)
+	}
+
+	return stats, nil
+}
+
+// List returns all backups on the WebDAV server whose name starts with the given prefix.
+// In case the prefix names a subdirectory, files in this directory are listed.
+func (b *webDavStorage) List(prefix string) ([]storage.Backup, error) {
+	dir, filePrefix := path.Split(prefix)
+	candidates, err := b.client.ReadDir(filepath.Join(b.DestinationPath, dir))
+	if err != nil {
+		if dir != "" && gowebdav.IsErrNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("(*webDavStorage).List: Error looking up backups from remote storage! %w", err)
+	}
+
+	var backups []storage.Backup
 	for _, candidate := range candidates {
-		if !strings.HasPrefix(candidate.Name(), pruningPrefix) {
+		if candidate.IsDir() || !strings.HasPrefix(candidate.Name(), filePrefix) {
 			continue
 		}
-		lenCandidates++
-		if candidate.ModTime().Before(deadline) {
-			matches = append(matches, candidate)
+		backup := storage.Backup{
+			Name:         path.Join(dir, candidate.Name()),
+			Size:         candidate.Size(),
+			LastModified: candidate.ModTime(),
 		}
+		if file, ok := candidate.(gowebdav.File); ok && file.ETag() != "" {
+			backup.Metadata = map[string]string{storage.MetadataETag: file.ETag()}
+		}
+		backups = append(backups, backup)
 	}
+	return backups, nil
+}
 
-	stats := &storage.PruneStats{
-		Total:  uint(lenCandidates),
-		Pruned: uint(len(matches)),
+// Open returns a reader for the backup of the given name on the WebDAV server.
+func (b *webDavStorage) Open(name string) (io.ReadCloser, error) {
+	stream, err := b.client.ReadStream(filepath.Join(b.DestinationPath, name))
+	if err != nil {
+		return nil, fmt.Errorf("(*webDavStorage).Open: Error downloading the file from WebDAV server! %w", err)
 	}
+	return stream, nil
+}
 
-	if err := b.DoPrune(b.Name(), len(matches), lenCandidates, "WebDAV backup(s)", func() error {
-		for _, match := range matches {
-			if err := b.client.Remove(filepath.Join(b.DestinationPath, match.Name())); err != nil {
-				return fmt.Errorf("(*webDavStorage).Prune: Error removing file from WebDAV storage! %w", err)
-			}
-		}
-		return nil
-	}); err != nil {
-		return stats, err
+// Delete removes the backup of the given name from the WebDAV server.
+func (b *webDavStorage) Delete(name string) error {
+	if err := b.client.Remove(filepath.Join(b.DestinationPath, name)); err != nil {
+		return fmt.Errorf("(*webDavStorage).Delete: Error removing file from WebDAV storage! %w", err)
 	}
-
-	return stats, nil
+	return nil
 }
@@ -0,0 +1,70 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local keys
+
+rm -f ./keys/id_ed25519 ./keys/id_ed25519.pub
+ssh-keygen -q -t ed25519 -N '' -f ./keys/id_ed25519
+
+docker-compose up -d
+sleep 5
+
+docker run --rm -v age_app_data:/data alpine \
+  ash -c 'echo "encrypted using age" > /data/marker'
+
+docker-compose exec backup backup
+
+expect_running_containers "2"
+
+if [ ! -f ./local/test.tar.gz.age ]; then
+  fail "Could not find encrypted backup in local storage."
+fi
+pass "Found backup encrypted using age in local storage."
+
+docker run --rm -v age_app_data:/data alpine rm /data/marker
+
+if docker-compose exec -T backup backup restore test.tar.gz.age; then
+  fail "Restoring succeeded without an identity."
+fi
+pass "Restoring without an identity failed."
+
+docker-compose exec -e AGE_IDENTITIES=/keys/id_ed25519 backup backup restore test.tar.gz.age
+
+sleep 5
+
+expect_running_containers "2"
+
+docker run --rm -v age_app_data:/data alpine \
+  ash -c '[ "$(cat /data/marker)" = "encrypted using age" ]' \
+  || fail "Restored file does not match the original one."
+
+pass "Restored backup encrypted using an SSH public key."
+
+docker-compose exec -e AGE_PUBLIC_KEYS= -e AGE_PASSPHRASE=1234secret -e BACKUP_FILENAME=passphrase.tar.gz \
+  backup backup
+
+docker run --rm -v age_app_data:/data alpine rm /data/marker
+
+if docker-compose exec -T -e AGE_PUBLIC_KEYS= -e AGE_PASSPHRASE=wrong backup backup restore passphrase.tar.gz.age; then
+  fail "Restoring succeeded using the wrong passphrase."
+fi
+pass "Restoring using the wrong passphrase failed."
+
+docker-compose exec -e AGE_PUBLIC_KEYS= -e AGE_PASSPHRASE=1234secret backup backup restore passphrase.tar.gz.age
+
+sleep 5
+
+expect_running_containers "2"
+
+docker run --rm -v age_app_data:/data alpine \
+  ash -c '[ "$(cat /data/marker)" = "encrypted using age" ]' \
+  || fail "Restored file does not match the original one."
+
+pass "Restored backup encrypted using a passphrase."
+
+docker-compose down --volumes
@@ -0,0 +1,39 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local
+
+docker-compose up -d
+sleep 5
+
+docker-compose exec backup backup
+
+tar -xf ./local/test.tar.gz -C ./local
+
+if [ "$(cat ./local/backup/dumps/small.txt)" != "hello" ]; then
+  fail "Unexpected output of small command: $(cat ./local/backup/dumps/small.txt)"
+fi
+pass "Found output of small command in archive."
+
+if [ -f ./local/backup/random ]; then
+  fail "Found large output in a single file."
+fi
+if [ "$(ls ./local/backup/random.part* | wc -l)" != "2" ]; then
+  fail "Expected large output to be stored in two parts, found: $(ls ./local/backup)"
+fi
+pass "Found large output stored in parts."
+
+expected="$(docker-compose exec -T large sha256sum /random | cut -d ' ' -f 1)"
+actual="$(cat ./local/backup/random.part* | sha256sum | cut -d ' ' -f 1)"
+if [ "$expected" != "$actual" ]; then
+  fail "Joined parts do not match the output of the command."
+fi
+pass "Joined parts match the output of the command."
+
+docker-compose down --volumes
+sudo rm -rf ./local
@@ -0,0 +1,51 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local
+
+docker-compose up -d
+sleep 5
+
+# The data needs to span multiple blocks so it is compressed by multiple
+# workers.
+docker run --rm -v compression_app_data:/data alpine \
+  ash -c 'head -c 20000000 /dev/urandom > /data/random && yes "compressible" | head -c 20000000 > /data/text'
+checksums="$(docker run --rm -v compression_app_data:/data alpine ash -c 'cd /data && sha256sum random text')"
+
+docker-compose exec backup backup
+
+tmp_dir=$(mktemp -d)
+tar -xzf ./local/test.tar.gz -C $tmp_dir
+if [ "$(cd $tmp_dir/backup/app_data && sha256sum random text)" != "$checksums" ]; then
+  fail "Expected archive compressed by multiple workers to be readable by gzip."
+fi
+sudo rm -rf $tmp_dir
+pass "Archive compressed by multiple workers is readable by gzip."
+
+docker-compose exec -e BACKUP_COMPRESSION=zst backup backup
+if [ ! -f ./local/test.tar.zst ]; then
+  fail "Expected zstd compressed archive to be created."
+fi
+
+docker run --rm -v compression_app_data:/data alpine rm -f /data/random /data/text
+docker-compose exec backup backup restore test.tar.zst
+if [ "$(docker run --rm -v compression_app_data:/data alpine ash -c 'cd /data && sha256sum random text')" != "$checksums" ]; then
+  fail "Expected archive compressed using zstd by multiple workers to be restored."
+fi
+pass "Archive compressed using zstd by multiple workers has been restored."
+
+if docker-compose exec -T -e BACKUP_COMPRESSION=xz backup backup; then
+  fail "Expected multiple workers to be rejected when using xz."
+fi
+if [ -f ./local/test.tar.xz ]; then
+  fail "Expected no archive to be created when using xz with multiple workers."
+fi
+pass "Multiple workers are rejected when using xz."
+
+docker-compose down --volumes
+sudo rm -rf ./local
@@ -0,0 +1,57 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local keys
+
+export GNUPGHOME=$(mktemp -d)
+gpg --batch --passphrase '' --quick-gen-key "Test <test@example.com>" default default never
+gpg --armor --export test@example.com > ./keys/public.asc
+gpg --armor --export-secret-keys test@example.com > ./keys/private.asc
+
+docker-compose up -d
+sleep 5
+
+docker run --rm -v gpg-public-keys_app_data:/data alpine \
+  ash -c 'echo "encrypted for a public key" > /data/marker'
+
+docker-compose exec backup backup
+
+expect_running_containers "2"
+
+if [ ! -f ./local/test.tar.gz.gpg ]; then
+  fail "Could not find encrypted backup in local storage."
+fi
+
+tmp_dir=$(mktemp -d)
+gpg --batch -d ./local/test.tar.gz.gpg | tar -xzf - -C $tmp_dir
+if [ ! -f $tmp_dir/backup/app_data/marker ]; then
+  fail "Could not find expected file in backup decrypted using gpg."
+fi
+pass "Decrypted backup using the private key."
+
+docker run --rm -v gpg-public-keys_app_data:/data alpine rm /data/marker
+
+if docker-compose exec -T backup backup restore test.tar.gz.gpg; then
+  fail "Restoring succeeded without a private key."
+fi
+pass "Restoring without a private key failed."
+
+docker-compose exec -e GPG_PRIVATE_KEY_RING=/keys/private.asc backup backup restore test.tar.gz.gpg
+
+sleep 5
+
+expect_running_containers "2"
+
+docker run --rm -v gpg-public-keys_app_data:/data alpine \
+  ash -c '[ "$(cat /data/marker)" = "encrypted for a public key" ]' \
+  || fail "Restored file does not match the original one."
+
+pass "Restored backup encrypted using a public key."
+
+rm -rf $GNUPGHOME
+docker-compose down --volumes
@@ -0,0 +1,34 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local
+
+docker-compose up -d
+sleep 5
+
+docker run --rm -v hardlinks_app_data:/data alpine \
+  ash -c 'head -c 100000 /dev/urandom > /data/original && mkdir /data/nested && ln /data/original /data/nested/link'
+
+docker-compose exec backup backup
+
+if [ -z "$(tar -tvzf ./local/test.tar.gz | grep 'app_data/nested/link link to .*app_data/original')" ]; then
+  fail "Expected archive to store a hard link, found: $(tar -tvzf ./local/test.tar.gz)"
+fi
+pass "Archive stores a hard link."
+
+docker run --rm -v hardlinks_app_data:/data alpine rm -rf /data/original /data/nested
+docker-compose exec backup backup restore test.tar.gz
+
+inodes="$(docker run --rm -v hardlinks_app_data:/data alpine stat -c '%i' /data/original /data/nested/link | uniq | wc -l)"
+if [ "$inodes" != "1" ]; then
+  fail "Expected restored files to share an inode."
+fi
+pass "Restored files are hard links to each other."
+
+docker-compose down --volumes
+sudo rm -rf ./local
@@ -11,18 +11,47 @@ mkdir -p local
 docker-compose up -d
 sleep 5
 docker-compose exec backup backup
+docker-compose exec \
+  -e BACKUP_FILENAME=include.tar.gz \
+  -e BACKUP_INCLUDE_GLOBS=data/nested/,data/me.txt \
+  -e BACKUP_EXCLUDE_GLOBS=data/nested/data.txt \
+  backup backup
 
 docker-compose down --volumes
 
 out=$(mktemp -d)
 sudo tar --same-owner -xvf ./local/test.tar.gz -C "$out"
 
-if [ ! -f "$out/backup/data/me.txt" ]; then
-  fail "Expected file was not found."
-fi
-pass "Expected file was found."
+expect_files () {
+  for file in $2; do
+    if [ ! -f "$1/backup/data/$file" ]; then
+      fail "Expected file $file was not found."
+    fi
+  done
+}
 
-if [ -f "$out/backup/data/skip.me" ]; then
-  fail "Ignored file was found."
-fi
-pass "Ignored file was not found."
+expect_no_files () {
+  for file in $2; do
+    if [ -e "$1/backup/data/$file" ]; then
+      fail "Ignored file $file was found."
+    fi
+  done
+}
+
+expect_files "$out" "me.txt keep.log secret.txt nested/cache nested/data.txt nested/debug.log"
+pass "Expected files were found."
+
+expect_no_files "$out" "skip.me app.log nested/trace.log nested/secret.txt"
+pass "Ignored files were not found."
+
+expect_no_files "$out" "cache skipdir.you"
+pass "Ignored directories were not found."
+
+include=$(mktemp -d)
+sudo tar --same-owner -xvf ./local/include.tar.gz -C "$include"
+
+expect_files "$include" "me.txt nested/cache nested/debug.log"
+pass "Included files were found."
+
+expect_no_files "$include" "keep.log secret.txt nested/data.txt nested/trace.log"
+pass "Files that are not included or excluded were not found."
@@ -0,0 +1,84 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local
+
+docker-compose up -d
+sleep 5
+
+docker run --rm -v incremental_app_data:/data alpine \
+  ash -c 'echo one > /data/one.txt && echo two > /data/two.txt'
+
+docker-compose exec backup backup
+
+sleep 1
+docker run --rm -v incremental_app_data:/data alpine \
+  ash -c 'rm /data/one.txt && echo three > /data/three.txt'
+
+docker-compose exec backup backup
+
+full=$(cd local && ls test-*.full-*.tar.gz)
+incremental=$(cd local && ls test-*.incremental-*-0001.tar.gz)
+if [ -z "$full" ] || [ -z "$incremental" ]; then
+  fail "Expected a full and an incremental backup, found: $(ls local)"
+fi
+chain=$(echo "$full" | sed -e 's/.*\.full-\([0-9a-f]*\)\..*/\1/')
+if [ -z "$(echo "$incremental" | grep "incremental-$chain-")" ]; then
+  fail "Expected incremental backup $incremental to be part of chain $chain."
+fi
+pass "Found full backup $full and incremental backup $incremental."
+
+# Chains are built from the names of backups, so restoring must not depend
+# on the order of modification times.
+sudo touch -d "1 hour ago" "./local/$incremental"
+docker run --rm -v incremental_app_data:/data alpine ash -c 'rm -rf /data/*'
+docker-compose exec backup backup restore latest
+
+docker run --rm -v incremental_app_data:/data alpine \
+  ash -c 'test -f /data/two.txt && test -f /data/three.txt' \
+  || fail "Could not find expected files after restoring the chain."
+docker run --rm -v incremental_app_data:/data alpine \
+  ash -c 'test ! -f /data/one.txt' \
+  || fail "Found file that has been deleted before taking the incremental backup."
+
+pass "Restored chain of full and incremental backup."
+
+# The manifest is persisted in a volume, so recreating the container
+# continues the existing chain.
+docker-compose up -d --force-recreate
+sleep 5
+docker-compose exec backup backup
+
+if [ -z "$(ls ./local | grep "incremental-$chain-0002")" ]; then
+  fail "Expected recreated container to continue chain $chain, found: $(ls ./local)"
+fi
+pass "Continued chain after recreating the container."
+
+# The full backup is older than BACKUP_RETENTION_DAYS, but incremental backups
+# depending on it are not, so it must not be pruned.
+sudo touch -d "10 days ago" "./local/$full"
+sleep 1
+docker-compose exec backup backup
+
+if [ ! -f "./local/$full" ]; then
+  fail "Full backup was pruned although incremental backups depend on it."
+fi
+pass "Full backup was kept as incremental backups depend on it."
+
+# Once the whole chain is older than BACKUP_RETENTION_DAYS, it is pruned
+# as a whole after taking a new full backup.
+sudo touch -d "9 days ago" ./local/test-*
+sleep 1
+docker-compose exec -e BACKUP_FULL_INTERVAL_DAYS=0 backup backup
+
+if [ "$(ls ./local | wc -l)" != "1" ] || [ -n "$(ls ./local | grep incremental)" ]; then
+  fail "Expected old chain to be pruned, found: $(ls ./local)"
+fi
+pass "Pruned old chain as a whole."
+
+docker-compose down --volumes
@@ -0,0 +1,21 @@
+#!/bin/sh
+
+# check.sh verifies that the sparse file in the given directory has been
+# restored including its contents, its extended attribute and its holes.
+
+set -e
+
+dir="$1"
+
+(cd "$dir" && sha256sum -c -s /archive/checksum) \
+  || { echo "Checksum of $dir/sparse does not match."; exit 1; }
+
+if [ "$(getfattr --only-values -n user.test "$dir/sparse")" != "hello" ]; then
+  echo "Extended attribute of $dir/sparse has not been restored."
+  exit 1
+fi
+
+if [ "$(du -k "$dir/sparse" | cut -f 1)" -gt 1024 ]; then
+  echo "Holes in $dir/sparse have not been restored."
+  exit 1
+fi
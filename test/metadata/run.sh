@@ -0,0 +1,51 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local
+
+docker-compose up -d
+sleep 5
+
+# The file is 100MB in size, but holds data in two small regions only and
+# ends with a hole.
+docker run --rm -v $(pwd)/local:/archive -v metadata_app_data:/data alpine ash -c \
+  'apk add --no-cache attr > /dev/null && \
+  truncate -s 100M /data/sparse && \
+  echo start | dd of=/data/sparse conv=notrunc 2> /dev/null && \
+  echo middle | dd of=/data/sparse bs=1M seek=50 conv=notrunc 2> /dev/null && \
+  setfattr -n user.test -v hello /data/sparse && \
+  cd /data && sha256sum sparse > /archive/checksum'
+
+docker-compose exec backup backup
+
+docker run --rm \
+  -v $(pwd)/local:/archive \
+  -v $(pwd)/check.sh:/check.sh:ro \
+  -v metadata_extracted:/extracted \
+  alpine ash -c \
+  "apk add --no-cache attr tar > /dev/null && \
+  tar --xattrs --xattrs-include='*' -xzf /archive/test.tar.gz -C /extracted && \
+  /bin/sh /check.sh /extracted/backup/app_data" \
+  || fail "Could not extract sparse file with extended attributes using GNU tar."
+pass "Extracted sparse file with extended attributes using GNU tar."
+
+docker run --rm -v metadata_app_data:/data alpine rm /data/sparse
+docker-compose exec backup backup restore test.tar.gz
+
+docker run --rm \
+  -v $(pwd)/local:/archive \
+  -v $(pwd)/check.sh:/check.sh:ro \
+  -v metadata_app_data:/data \
+  alpine ash -c \
+  "apk add --no-cache attr > /dev/null && /bin/sh /check.sh /data" \
+  || fail "Could not restore sparse file with extended attributes."
+pass "Restored sparse file with extended attributes."
+
+docker-compose down --volumes
+docker volume rm metadata_extracted
+sudo rm -rf ./local
@@ -0,0 +1,65 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local
+
+docker-compose up -d
+sleep 5
+
+docker run --rm -v per-source_app_data:/data alpine ash -c 'echo app > /data/app.txt'
+docker run --rm -v per-source_db_data:/data alpine ash -c 'echo db > /data/db.txt'
+
+docker-compose exec backup backup
+
+app_backup=$(cd local && ls test-app_*.tar.gz)
+db_backup=$(cd local && ls test-db_*.tar.gz)
+if [ -z "$app_backup" ] || [ -z "$db_backup" ]; then
+  fail "Expected one archive per source, found: $(ls ./local)"
+fi
+pass "Found one archive per source."
+
+if [ -n "$(tar -tzf "./local/$app_backup" | grep db.txt)" ]; then
+  fail "Expected archive of app to contain its own files only, found: $(tar -tzf "./local/$app_backup")"
+fi
+if [ -z "$(tar -tzf "./local/$db_backup" | grep 'backup/db/db.txt')" ]; then
+  fail "Expected archive of db to contain its files, found: $(tar -tzf "./local/$db_backup")"
+fi
+pass "Archives contain the files of their source only."
+
+# Only the backups of app are outdated, so the backup of db must be kept
+# although it is the only backup of db that exists.
+sudo touch -d "10 days ago" "./local/$app_backup"
+sleep 1
+docker-compose exec backup backup
+
+if [ -f "./local/$app_backup" ]; then
+  fail "Expected outdated backup of app to be pruned."
+fi
+if [ ! -f "./local/$db_backup" ]; then
+  fail "Expected backup of db to be kept, as it has not expired."
+fi
+if [ "$(ls ./local | wc -l)" != "3" ]; then
+  fail "Expected 3 backups to exist, found: $(ls ./local)"
+fi
+pass "Backups have been pruned for each source on its own."
+
+docker run --rm -v per-source_app_data:/data alpine ash -c 'echo changed > /data/app.txt'
+docker run --rm -v per-source_db_data:/data alpine ash -c 'rm /data/db.txt'
+
+docker-compose exec backup backup restore "$db_backup"
+
+if [ "$(docker run --rm -v per-source_db_data:/data alpine cat /data/db.txt)" != "db" ]; then
+  fail "Expected db to be restored."
+fi
+if [ "$(docker run --rm -v per-source_app_data:/data alpine cat /data/app.txt)" != "changed" ]; then
+  fail "Expected app to be left alone when restoring db."
+fi
+pass "Restored a single source without touching others."
+
+docker-compose down --volumes
+sudo rm -rf ./local
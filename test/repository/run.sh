@@ -0,0 +1,73 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local
+
+docker-compose up -d
+sleep 5
+
+# Random data does not compress, so it is split into multiple chunks.
+docker run --rm -v repository_app_data:/data alpine \
+  ash -c 'head -c 8000000 /dev/urandom > /data/random && cd /data && sha256sum random > random.sha256'
+
+docker-compose exec backup backup
+
+if [ "$(ls ./local/*.snapshot.gpg | wc -l)" != "1" ]; then
+  fail "Expected a single snapshot, found: $(ls ./local)"
+fi
+if [ -n "$(ls ./local | grep chunk-)" ]; then
+  fail "Found chunks next to snapshots: $(ls ./local)"
+fi
+first_chunks=$(ls ./local/chunks | wc -l)
+if [ "$first_chunks" -lt 2 ]; then
+  fail "Expected snapshot to consist of multiple chunks, found: $(ls ./local/chunks)"
+fi
+pass "Stored snapshot consisting of $first_chunks chunks."
+
+sleep 1
+docker-compose exec backup backup
+
+new_chunks=$(($(ls ./local/chunks | wc -l) - first_chunks))
+if [ "$new_chunks" -ge "$first_chunks" ]; then
+  fail "Expected unchanged data to be deduplicated, but $new_chunks new chunks were stored."
+fi
+pass "Second snapshot stored $new_chunks new chunk(s) only."
+
+docker run --rm -v repository_app_data:/data alpine rm /data/random
+docker-compose exec backup backup restore latest
+
+docker run --rm -v repository_app_data:/data alpine ash -c 'cd /data && sha256sum -c random.sha256' \
+  || fail "Restored file does not match the original one."
+pass "Restored file from repository."
+
+# Once both snapshots are older than BACKUP_RETENTION_DAYS, they are pruned
+# and all chunks that are only referenced by them are deleted.
+sudo touch -d "10 days ago" ./local/*.snapshot.gpg
+chunks_before=$(ls ./local/chunks | wc -l)
+docker run --rm -v repository_app_data:/data alpine \
+  ash -c 'head -c 1000000 /dev/urandom > /data/random && cd /data && sha256sum random > random.sha256'
+sleep 1
+docker-compose exec backup backup
+
+if [ "$(ls ./local/*.snapshot.gpg | wc -l)" != "1" ]; then
+  fail "Expected old snapshots to be pruned, found: $(ls ./local)"
+fi
+if [ "$(ls ./local/chunks | wc -l)" -ge "$chunks_before" ]; then
+  fail "Expected chunks of pruned snapshots to be deleted, found $(ls ./local/chunks | wc -l) chunks."
+fi
+pass "Deleted chunks that are not referenced anymore."
+
+docker run --rm -v repository_app_data:/data alpine rm /data/random
+docker-compose exec backup backup restore latest
+
+docker run --rm -v repository_app_data:/data alpine ash -c 'cd /data && sha256sum -c random.sha256' \
+  || fail "Restored file does not match the original one after pruning."
+pass "Restored file from repository after pruning."
+
+docker-compose down --volumes
+sudo rm -rf ./local
@@ -0,0 +1,71 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local
+
+docker-compose up -d
+sleep 5
+
+docker run --rm -v reproducible_app_data:/data alpine \
+  ash -c 'mkdir -p /data/nested && head -c 100000 /dev/urandom > /data/random && echo hello > /data/nested/hello.txt'
+
+docker-compose exec backup backup
+# Access times change when reading files, which must not end up in the archive.
+sleep 2
+docker-compose exec -e BACKUP_FILENAME=second.tar.gz backup backup
+
+first="$(sha256sum < ./local/first.tar.gz | cut -d ' ' -f 1)"
+if [ "$first" != "$(sha256sum < ./local/second.tar.gz | cut -d ' ' -f 1)" ]; then
+  fail "Expected archives of unchanged sources to be identical."
+fi
+pass "Archives of unchanged sources are identical."
+
+if [ "$first" != "$(cut -d ' ' -f 1 ./local/first.tar.gz.sha256)" ]; then
+  fail "Expected checksum file to contain the checksum of the archive, got: $(cat ./local/first.tar.gz.sha256)"
+fi
+pass "Checksum file contains the checksum of the archive."
+
+docker-compose exec \
+  -e BACKUP_FILENAME=encrypted.tar.gz \
+  -e BACKUP_SKIP_UNCHANGED=true \
+  -e GPG_PASSPHRASE=1234secret \
+  backup backup
+
+if [ ! -f ./local/encrypted.tar.gz.gpg ]; then
+  fail "Expected encrypted backup to be uploaded, as its checksum differs."
+fi
+if [ "$first" = "$(cut -d ' ' -f 1 ./local/encrypted.tar.gz.gpg.sha256)" ]; then
+  fail "Expected checksum of encrypted backup not to be the plain checksum of the archive."
+fi
+pass "Checksum of encrypted backup does not reveal the checksum of the archive."
+
+docker-compose exec \
+  -e BACKUP_FILENAME=skipped.tar.gz \
+  -e BACKUP_SKIP_UNCHANGED=true \
+  -e GPG_PASSPHRASE=1234secret \
+  backup backup
+
+if [ -f ./local/skipped.tar.gz.gpg ]; then
+  fail "Expected upload of unchanged backup to be skipped."
+fi
+pass "Upload of unchanged backup has been skipped."
+
+docker run --rm -v reproducible_app_data:/data alpine ash -c 'echo changed > /data/nested/hello.txt'
+docker-compose exec \
+  -e BACKUP_FILENAME=changed.tar.gz \
+  -e BACKUP_SKIP_UNCHANGED=true \
+  -e GPG_PASSPHRASE=1234secret \
+  backup backup
+
+if [ ! -f ./local/changed.tar.gz.gpg ]; then
+  fail "Expected backup of changed sources to be uploaded."
+fi
+pass "Backup of changed sources has been uploaded."
+
+docker-compose down --volumes
+sudo rm -rf ./local
@@ -0,0 +1,30 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local
+
+docker-compose up -d
+sleep 5
+
+docker-compose exec backup backup
+
+expect_running_containers "2"
+
+docker-compose exec offen rm /var/opt/offen/offen.db
+docker-compose exec backup backup restore latest
+
+sleep 5
+
+expect_running_containers "2"
+
+docker-compose exec -T offen test -f /var/opt/offen/offen.db \
+  || fail "Could not find expected file in restored volume."
+
+pass "Found relevant files in restored volume."
+
+docker-compose down --volumes
@@ -0,0 +1,46 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local secrets
+
+echo "0 0 5 31 2 ?" > ./secrets/cron_expression
+echo 1234secret > ./secrets/gpg_passphrase
+
+docker-compose up -d
+sleep 5
+
+if ! docker-compose exec -T backup crontab -l | grep -q '^0 0 5 31 2 ? backup'; then
+  fail "Cron expression was not read from BACKUP_CRON_EXPRESSION_FILE."
+fi
+pass "Cron expression was read from BACKUP_CRON_EXPRESSION_FILE."
+
+docker-compose exec backup backup
+
+expect_running_containers "2"
+
+tmp_dir=$(mktemp -d)
+echo 1234secret | gpg -d --pinentry-mode loopback --yes --passphrase-fd 0 ./local/test.tar.gz.gpg > ./local/decrypted.tar.gz
+tar -xf ./local/decrypted.tar.gz -C $tmp_dir
+if [ ! -f $tmp_dir/backup/app_data/offen.db ]; then
+  fail "Could not find expected file in untared archive."
+fi
+rm ./local/decrypted.tar.gz
+
+pass "Decrypted backup using the passphrase read from GPG_PASSPHRASE_FILE."
+
+if docker-compose exec -T -e GPG_PASSPHRASE=other backup backup; then
+  fail "Backup succeeded with both GPG_PASSPHRASE and GPG_PASSPHRASE_FILE set."
+fi
+pass "Setting both GPG_PASSPHRASE and GPG_PASSPHRASE_FILE failed."
+
+if docker-compose exec -T -e GPG_PASSPHRASE= backup backup; then
+  fail "Backup succeeded with an empty GPG_PASSPHRASE and GPG_PASSPHRASE_FILE set."
+fi
+pass "Setting an empty GPG_PASSPHRASE and GPG_PASSPHRASE_FILE failed."
+
+docker-compose down --volumes
@@ -0,0 +1,81 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local keys
+
+export GNUPGHOME=$(mktemp -d)
+gpg --batch --passphrase '' --quick-gen-key "Signer <signer@example.com>" default default never
+gpg --batch --passphrase '' --quick-gen-key "Other <other@example.com>" default default never
+gpg --armor --export signer@example.com > ./keys/signing-public.asc
+gpg --armor --export-secret-keys signer@example.com > ./keys/signing.asc
+gpg --armor --export-secret-keys other@example.com > ./keys/other.asc
+
+docker-compose up -d
+sleep 5
+
+docker-compose exec backup backup
+
+expect_running_containers "2"
+
+if [ ! -f ./local/test.tar.gz.sig ]; then
+  fail "Could not find signature in local storage."
+fi
+gpg --verify ./local/test.tar.gz.sig ./local/test.tar.gz \
+  || fail "Signature could not be verified using gpg."
+pass "Found valid signature next to backup."
+
+docker-compose exec backup backup verify test.tar.gz
+docker-compose exec backup backup restore test.tar.gz
+
+sleep 5
+
+expect_running_containers "2"
+
+pass "Verified and restored signed backup."
+
+# Changing a single byte of a copy of the backup invalidates its signature.
+docker run --rm -v $(pwd)/local:/archive alpine ash -c \
+  'cp /archive/test.tar.gz /archive/tampered.tar.gz && cp /archive/test.tar.gz.sig /archive/tampered.tar.gz.sig && printf x | dd of=/archive/tampered.tar.gz bs=1 seek=100 conv=notrunc'
+
+if docker-compose exec -T backup backup verify tampered.tar.gz; then
+  fail "Verifying tampered backup succeeded."
+fi
+if docker-compose exec -T backup backup restore tampered.tar.gz; then
+  fail "Restoring tampered backup succeeded."
+fi
+pass "Tampered backup was refused."
+
+docker-compose exec -e GPG_SIGNING_KEY= -e BACKUP_FILENAME=unsigned.tar.gz backup backup
+
+if [ -f ./local/unsigned.tar.gz.sig ]; then
+  fail "Found signature for unsigned backup."
+fi
+if docker-compose exec -T backup backup verify unsigned.tar.gz; then
+  fail "Verifying unsigned backup succeeded."
+fi
+if docker-compose exec -T backup backup restore unsigned.tar.gz; then
+  fail "Restoring unsigned backup succeeded."
+fi
+pass "Unsigned backup was refused."
+
+docker-compose exec -e GPG_SIGNING_KEY=/keys/other.asc -e BACKUP_FILENAME=other.tar.gz backup backup
+
+if docker-compose exec -T backup backup verify other.tar.gz; then
+  fail "Verifying backup signed using an unknown key succeeded."
+fi
+if docker-compose exec -T backup backup restore other.tar.gz; then
+  fail "Restoring backup signed using an unknown key succeeded."
+fi
+pass "Backup signed using an unknown key was refused."
+
+sleep 5
+
+expect_running_containers "2"
+
+rm -rf $GNUPGHOME
+docker-compose down --volumes
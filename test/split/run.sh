@@ -0,0 +1,42 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local
+
+docker-compose up -d
+sleep 5
+
+# Random data does not compress, so the archive is bigger than a single part.
+docker run --rm -v split_app_data:/data alpine \
+  ash -c 'head -c 500000 /dev/urandom > /data/random && cd /data && sha256sum random > random.sha256'
+
+docker-compose exec backup backup
+
+expect_running_containers "2"
+
+if [ -f ./local/test.tar.gz ]; then
+  fail "Found unsplit archive in local storage."
+fi
+if [ "$(ls ./local/test.tar.gz.part* | wc -l)" -lt 2 ]; then
+  fail "Expected archive to be split into multiple parts, found: $(ls ./local)"
+fi
+pass "Archive was split into $(ls ./local/test.tar.gz.part* | wc -l) parts."
+
+docker run --rm -v split_app_data:/data alpine rm /data/random
+docker-compose exec backup backup restore test.tar.gz
+
+sleep 5
+
+expect_running_containers "2"
+
+docker run --rm -v split_app_data:/data alpine ash -c 'cd /data && sha256sum -c random.sha256' \
+  || fail "Restored file does not match the original one."
+
+pass "Restored file from split archive."
+
+docker-compose down --volumes
@@ -0,0 +1,33 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local
+
+docker-compose up -d
+sleep 15
+
+if [ -z "$(docker-compose exec -T app find /data -name db.sqlite-wal -size +0)" ]; then
+  fail "Expected database to hold data in its write-ahead log."
+fi
+
+docker-compose exec backup backup
+
+if [ -n "$(tar -tzf ./local/test.tar.gz | grep 'db.sqlite-')" ]; then
+  fail "Expected journals not to be archived, found: $(tar -tzf ./local/test.tar.gz)"
+fi
+pass "Journals have not been archived."
+
+value="$(docker run --rm -v $(pwd)/local:/archive alpine:3.16 \
+  ash -c 'apk add --no-cache sqlite > /dev/null && tar -xzf /archive/test.tar.gz -C /tmp && sqlite3 /tmp/backup/app_data/db.sqlite "SELECT v FROM t"')"
+if [ "$value" != "hello" ]; then
+  fail "Expected archived database to contain the data held in the write-ahead log, got: $value"
+fi
+pass "Archived database contains the data held in the write-ahead log."
+
+docker-compose down --volumes
+sudo rm -rf ./local
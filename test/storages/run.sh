@@ -0,0 +1,45 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local
+ssh-keygen -t rsa -m pem -b 4096 -N "test1234" -f id_rsa -C "docker-volume-backup@local"
+
+docker-compose up -d
+sleep 5
+
+docker-compose exec backup backup
+
+# A backup is put into a subdirectory of each storage, which must not be
+# listed as none of the backends descend into subdirectories.
+mkdir -p ./local/nested
+cp ./local/test.tar.gz ./local/nested/test.tar.gz
+docker-compose exec -T minio ash -c 'mkdir -p /data/backup/nested && cp /data/backup/test.tar.gz /data/backup/nested/'
+docker-compose exec -T webdav sh -c 'mkdir -p /var/lib/dav/data/nested && cp /var/lib/dav/data/test.tar.gz /var/lib/dav/data/nested/'
+docker-compose exec -T ssh sh -c 'mkdir -p /tmp/nested && cp /tmp/test.tar.gz /tmp/nested/'
+
+docker-compose exec -T backup backup list -json > ./local/list.json
+
+for storage in Local S3 SSH WebDAV; do
+  if [ "$(grep -c "\"storage\": \"$storage\"" ./local/list.json)" != "1" ]; then
+    fail "Expected exactly one backup to be listed for storage $storage."
+  fi
+done
+pass "Found exactly one backup per storage."
+
+if grep -q nested ./local/list.json; then
+  fail "Expected backups in subdirectories not to be listed."
+fi
+pass "Backups in subdirectories have not been listed."
+
+if [ "$(grep -c '"ETag"' ./local/list.json)" != "2" ]; then
+  fail "Expected an ETag to be listed for the S3 and WebDAV storages only."
+fi
+pass "Found ETags for the S3 and WebDAV storages."
+
+docker-compose down --volumes
+rm -f id_rsa id_rsa.pub
@@ -0,0 +1,44 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local
+
+docker-compose up -d
+sleep 5
+
+docker run --rm -v verify_app_data:/data alpine \
+  ash -c 'head -c 1000000 /dev/urandom > /data/random && echo hello > /data/hello.txt'
+
+docker-compose exec -T backup backup > ./local/backup.log 2>&1
+if ! grep -q 'Verified backup `test.tar.gz`, found [0-9]* entries' ./local/backup.log; then
+  fail "Expected backup to be verified after it has been created: $(cat ./local/backup.log)"
+fi
+pass "Backup has been verified after it has been created."
+
+docker-compose exec -e GPG_PASSPHRASE=1234secret backup backup
+docker-compose exec -T -e GPG_PASSPHRASE=1234secret backup backup verify test.tar.gz.gpg > ./local/verify.log 2>&1
+if ! grep -q 'Verified backup `test.tar.gz.gpg`, found [0-9]* entries' ./local/verify.log; then
+  fail "Expected encrypted backup to be verified: $(cat ./local/verify.log)"
+fi
+pass "Encrypted backup has been verified."
+
+for backup in test.tar.gz test.tar.gz.gpg; do
+  head -c 500000 "./local/$backup" > "./local/corrupt-$backup"
+  if docker-compose exec -T -e GPG_PASSPHRASE=1234secret backup backup verify "corrupt-$backup"; then
+    fail "Expected verifying truncated backup corrupt-$backup to fail."
+  fi
+done
+pass "Verifying truncated backups failed."
+
+if docker-compose exec -T -e GPG_PASSPHRASE=wrong backup backup verify test.tar.gz.gpg; then
+  fail "Expected verifying backup using the wrong passphrase to fail."
+fi
+pass "Verifying backup using the wrong passphrase failed."
+
+docker-compose down --volumes
+sudo rm -rf ./local
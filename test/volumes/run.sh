@@ -0,0 +1,45 @@
+#!/bin/sh
+
+set -e
+
+cd "$(dirname "$0")"
+. ../util.sh
+current_test=$(basename $(pwd))
+
+mkdir -p local
+
+docker-compose up -d
+sleep 5
+
+docker-compose exec backup backup
+
+expect_running_containers "2"
+
+backup=$(cd local && ls test-volumes_app_data_*.tar.gz)
+if [ -z "$backup" ]; then
+  fail "Could not find archive of labeled volume."
+fi
+pass "Found archive $backup of labeled volume."
+
+docker-compose rm --stop --force offen
+docker volume rm volumes_app_data
+if docker volume inspect volumes_app_data > /dev/null 2>&1; then
+  fail "Expected volume to be removed before restoring."
+fi
+
+docker-compose exec backup backup restore "$backup"
+
+docker volume inspect volumes_app_data --format '{{ index .Labels "docker-volume-backup.include" }}' | grep -q true \
+  || fail "Restored volume does not carry its labels."
+
+docker run --rm -v volumes_app_data:/data alpine test -f /data/offen.db \
+  || fail "Could not find expected file in restored volume."
+
+pass "Recreated missing volume and found relevant files."
+
+if [ -n "$(docker ps -aq --filter label=docker-volume-backup.helper=true)" ]; then
+  fail "Expected helper containers to be removed."
+fi
+pass "Helper containers have been removed."
+
+docker-compose down --volumes